@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/statcan/profile-state-controller/pkg/audit"
+)
+
+// runAudit runs the audit subcommands. The only one is verify, which checks the hash chain of an
+// audit log and its rotated files.
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	path := flags.String("audit-log", auditLog, "Path of the audit log. Its rotated files are verified first, oldest first.")
+	keyFile := flags.String("audit-hmac-key-file", auditKeyFile, "Path of the file holding the key of the HMACs, when the audit log was written with one.")
+	pruned := flags.Bool("pruned", false, "Accept a chain whose first record is not the first one written, when old rotated files were removed.")
+	head := flags.String("head", "", "Hash of the newest record according to the controller logs, which must be part of the chain.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: profile-state-controller audit verify [flags] [files...]")
+		fmt.Fprintln(flags.Output(), "Files are verified in the order given, instead of the files of --audit-log.")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	flags.Parse(args[1:])
+
+	files := flags.Args()
+	if len(files) == 0 {
+		if *path == "" {
+			return fmt.Errorf("either --audit-log or files are required")
+		}
+		var err error
+		if files, err = audit.Files(*path); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no audit log found at %s", *path)
+		}
+	}
+
+	key, err := readAuditKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	count, err := audit.Verify(files, audit.VerifyOptions{Key: key, Pruned: *pruned, Head: *head})
+	if err != nil {
+		return fmt.Errorf("verification failed after %d valid records: %v", count, err)
+	}
+	fmt.Printf("%d records in %d files are intact.\n", count, len(files))
+	return nil
+}
+
+// readAuditKey reads the HMAC key of the audit log, or returns nil when there is no key file
+func readAuditKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("the audit key file %s is empty", path)
+	}
+	return key, nil
+}
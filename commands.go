@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	kubeflow "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned"
+	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/controller"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// commands are the subcommands that run once and exit instead of starting the controller
+var commands = map[string]func(args []string) error{
+	"audit":    runAudit,
+	"evaluate": runEvaluate,
+	"explain":  runExplain,
+	"history":  runHistory,
+	"report":   runReport,
+}
+
+// runCommand runs the subcommand named by the first argument
+func runCommand(args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q, expected one of: %s\n", args[0], strings.Join(names, ", "))
+		os.Exit(2)
+	}
+
+	// The detectors log every unexcepted user, which would drown the command's output
+	log.SetLevel(log.WarnLevel)
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// buildClients connects to the cluster given by the --kubeconfig and --master flags
+func buildClients() (kubernetes.Interface, kubeflow.Interface, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building kubeconfig: %v", err)
+	}
+	kubeclient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building kubernetes clientset: %v", err)
+	}
+	kubeflowclient, err := kubeflow.NewForConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building kubeflow client: %v", err)
+	}
+	return kubeclient, kubeflowclient, nil
+}
+
+// loadExceptions reads the exceptions from a file when one is given, or else from the
+// ConfigMap (namespace/name) that is mounted into the controller
+func loadExceptions(ctx context.Context, kubeclient kubernetes.Interface, file string, configMap string) (map[string][]string, error) {
+	var exceptions map[string][]string
+	var err error
+	if file != "" {
+		exceptions, err = controller.LoadConf(file)
+	} else {
+		namespace, name := splitNamespacedName(configMap)
+		exceptions, err = controller.FetchExceptions(ctx, kubeclient, namespace, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load exceptions: %v", err)
+	}
+	return exceptions, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/statcan/profile-state-controller/pkg/controller"
+)
+
+// runEvaluate computes the state labels of the namespaces described by YAML manifests, without a cluster
+func runEvaluate(args []string) error {
+	flags := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	dir := flags.String("dir", ".", "Directory of YAML manifests with Profiles, Pods, RoleBindings and PersistentVolumeClaims, read recursively.")
+	exceptionsFile := flags.String("exceptions", "", "Path to a non-employee exceptions file, in the format of non-employee-exceptions.yaml. No exceptions apply when empty.")
+	output := flags.String("output", "table", "Output format: table or json.")
+	flags.Parse(args)
+
+	exceptions := map[string][]string{}
+	if *exceptionsFile != "" {
+		var err error
+		if exceptions, err = controller.LoadConf(*exceptionsFile); err != nil {
+			return fmt.Errorf("failed to load exceptions: %v", err)
+		}
+	}
+
+	manifests, err := controller.LoadManifests(*dir)
+	if err != nil {
+		return err
+	}
+
+	evaluations := []controller.Evaluation{}
+	for _, namespace := range manifests.Namespaces() {
+		evaluations = append(evaluations, controller.Evaluate(namespace, manifests.ObjectsIn(namespace), exceptions))
+	}
+
+	switch *output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(evaluations)
+	case "table":
+		return printEvaluations(os.Stdout, evaluations)
+	default:
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+}
+
+// printEvaluations writes one row per label and reason
+func printEvaluations(out io.Writer, evaluations []controller.Evaluation) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tLABEL\tVALUE\tREASON")
+	for _, evaluation := range evaluations {
+		namespace := evaluation.Namespace
+		for _, label := range controller.StateLabels() {
+			value := evaluation.Labels[label]
+			for _, reason := range evaluation.Reasons[label] {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", namespace, shortLabel(label), value, reason)
+				namespace, label, value = "", "", ""
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// shortLabel drops the state.aaw.statcan.gc.ca/ prefix to keep tables narrow
+func shortLabel(label string) string {
+	if i := strings.Index(label, "/"); i >= 0 {
+		return label[i+1:]
+	}
+	return label
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/statcan/profile-state-controller/pkg/controller"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runExplain walks through every decision behind the labels of a live namespace
+func runExplain(args []string) error {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "Path to a kubeconfig. Only required if out-of-cluster.")
+	flags.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	exceptionsFile := flags.String("exceptions", "", "Path to a non-employee exceptions file. When empty, the exceptions are read from --exceptions-configmap.")
+	exceptionsConfigMap := flags.String("exceptions-configmap", "statcan-system/non-employee-exceptions", "Namespace/name of the ConfigMap holding the exceptions mounted into the controller.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: profile-state-controller explain [flags] <namespace>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	namespace := flags.Arg(0)
+
+	kubeclient, kubeflowclient, err := buildClients()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	exceptions, err := loadExceptions(ctx, kubeclient, *exceptionsFile, *exceptionsConfigMap)
+	if err != nil {
+		return err
+	}
+
+	objects, err := controller.FetchNamespaceObjects(ctx, kubeclient, namespace)
+	if err != nil {
+		return err
+	}
+
+	// The live labels are only shown for the objects that exist
+	live := map[string]map[string]string{}
+	profile, err := kubeflowclient.KubeflowV1().Profiles().Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		live["PROFILE"] = profile.Labels
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	ns, err := kubeclient.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		live["NAMESPACE"] = ns.Labels
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	evaluation := controller.Evaluate(namespace, objects, exceptions)
+	printExplanation(os.Stdout, evaluation, controller.Explain(objects, exceptions), live)
+	return nil
+}
+
+// printExplanation writes the decisions, then the computed labels next to the live ones
+func printExplanation(out io.Writer, evaluation controller.Evaluation, decisions []string, live map[string]map[string]string) {
+	fmt.Fprintf(out, "Namespace %s\n\nDecisions:\n", evaluation.Namespace)
+	if len(decisions) == 0 {
+		fmt.Fprintln(out, "  no pods, RoleBindings or PVCs")
+	}
+	for _, decision := range decisions {
+		fmt.Fprintf(out, "  - %s\n", decision)
+	}
+
+	columns := []string{}
+	for _, column := range []string{"PROFILE", "NAMESPACE"} {
+		if _, ok := live[column]; ok {
+			columns = append(columns, column)
+		}
+	}
+
+	fmt.Fprintln(out, "\nLabels:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprint(w, "  LABEL\tCOMPUTED")
+	for _, column := range columns {
+		fmt.Fprintf(w, "\t%s", column)
+	}
+	fmt.Fprintln(w, "\t")
+	differences := 0
+	for _, label := range controller.StateLabels() {
+		computed := evaluation.Labels[label]
+		fmt.Fprintf(w, "  %s\t%s", shortLabel(label), computed)
+		differs := false
+		for _, column := range columns {
+			value, ok := live[column][label]
+			if !ok {
+				value = "<unset>"
+			}
+			if value != computed {
+				differs = true
+			}
+			fmt.Fprintf(w, "\t%s", value)
+		}
+		if differs {
+			differences++
+			fmt.Fprint(w, "\tdiffers")
+		}
+		fmt.Fprintln(w, "\t")
+	}
+	w.Flush()
+
+	if len(columns) == 0 {
+		fmt.Fprintf(out, "\nThere is no Profile or Namespace named %s, so nothing is labelled.\n", evaluation.Namespace)
+	} else if differences > 0 {
+		fmt.Fprintf(out, "\n%d labels differ from the computed state. The controller corrects them on its next sync, unless it is in dry-run mode or not running.\n", differences)
+	}
+
+	fmt.Fprintln(out, "\nReasons:")
+	for _, label := range controller.StateLabels() {
+		for _, reason := range evaluation.Reasons[label] {
+			fmt.Fprintf(out, "  %s=%s: %s\n", shortLabel(label), evaluation.Labels[label], reason)
+		}
+	}
+}
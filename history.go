@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/statcan/profile-state-controller/pkg/history"
+)
+
+// runHistory prints the state transitions recorded for a Profile
+func runHistory(args []string) error {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "Path to a kubeconfig. Only required if out-of-cluster.")
+	flags.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	namespace := flags.String("history-namespace", "statcan-system", "Namespace in which the controller keeps the history ConfigMaps.")
+	label := flags.String("label", "", "Only show the transitions of this label, with or without the state.aaw.statcan.gc.ca/ prefix.")
+	since := flags.Duration("since", 0, "Only show the transitions of this last duration, for example 72h.")
+	output := flags.String("output", "table", "Output format: table or json.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: profile-state-controller history [flags] <profile>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q, expected table or json", *output)
+	}
+
+	kubeclient, _, err := buildClients()
+	if err != nil {
+		return err
+	}
+
+	// Retention is applied by the controller, so every stored entry is listed
+	store := history.NewStore(kubeclient, history.Options{Namespace: *namespace})
+	entries, err := store.List(context.Background(), flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	filtered := []history.Entry{}
+	for _, entry := range entries {
+		if *label != "" && entry.Label != *label && shortLabel(entry.Label) != *label {
+			continue
+		}
+		if *since > 0 && time.Since(entry.Time) > *since {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(filtered)
+	}
+	return printHistory(os.Stdout, flags.Arg(0), filtered)
+}
+
+// printHistory writes one row per transition, oldest first
+func printHistory(out io.Writer, profile string, entries []history.Entry) error {
+	if len(entries) == 0 {
+		fmt.Fprintf(out, "No state transitions are recorded for profile %s.\n", profile)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tLABEL\tFROM\tTO\tTRIGGER\tREASONS")
+	for _, entry := range entries {
+		from := entry.From
+		if from == "" {
+			from = "<unset>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), shortLabel(entry.Label),
+			from, entry.To, entry.Trigger, strings.Join(entry.Reasons, "; "))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElectionIdentity returns the name of this replica, taken from the POD_NAME
+// environment variable (set through the downward API) or the hostname.
+func leaderElectionIdentity() string {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("error getting hostname for leader election identity: %v", err)
+	}
+	return hostname
+}
+
+// runWithLeaderElection blocks until stopCh is closed, calling run only while this replica
+// holds the Lease. The Lease is released when stopCh closes so that a standby replica can
+// take over without waiting for it to expire.
+func runWithLeaderElection(kubeclient kubernetes.Interface, stopCh <-chan struct{}, run func(stopCh <-chan struct{})) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	identity := leaderElectionIdentity()
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		leaderElectionNamespace,
+		leaderElectionID,
+		kubeclient.CoreV1(),
+		kubeclient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity},
+	)
+	if err != nil {
+		log.Fatalf("error creating leader election lock: %v", err)
+	}
+
+	// run is started in its own goroutine, so wait for it to return before returning, unless
+	// leadership was never acquired
+	var runningMutex sync.Mutex
+	var running chan struct{}
+	returned := false
+	leaderelection.RunOrDie(ctx, leaderElectionConfig(ctx, lock, func(stopCh <-chan struct{}) {
+		runningMutex.Lock()
+		if returned {
+			runningMutex.Unlock()
+			return
+		}
+		running = make(chan struct{})
+		runningMutex.Unlock()
+		defer close(running)
+		run(stopCh)
+	}, func() {
+		// Another replica may already be writing labels, so stop immediately
+		log.Fatalf("%s lost leadership", identity)
+	}))
+
+	runningMutex.Lock()
+	returned = true
+	done := running
+	runningMutex.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// leaderElectionConfig calls run while the Lease held through lock is ours. lost is called
+// when the Lease could not be renewed; giving it up because ctx was cancelled is not a loss.
+func leaderElectionConfig(ctx context.Context, lock resourcelock.Interface, run func(stopCh <-chan struct{}), lost func()) leaderelection.LeaderElectionConfig {
+	identity := lock.Identity()
+	return leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            leaderElectionID,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("%s acquired leadership", identity)
+				run(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					log.Printf("%s released leadership", identity)
+					return
+				}
+				lost()
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					log.Printf("%s is the leader, waiting as standby", current)
+				}
+			},
+		},
+	}
+}
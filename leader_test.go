@@ -0,0 +1,185 @@
+/*
+These tests run the leader election callbacks against an in-memory lock, to check that the Lease
+is released when the controller shuts down and that losing it is fatal.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// fakeLock keeps the leader election record in memory. Updates fail once failUpdates is set.
+type fakeLock struct {
+	sync.Mutex
+	identity    string
+	record      *resourcelock.LeaderElectionRecord
+	failUpdates bool
+}
+
+func (l *fakeLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.record == nil {
+		return nil, nil, apierrors.NewNotFound(coordinationv1.Resource("leases"), leaderElectionID)
+	}
+	record := *l.record
+	return &record, []byte(record.HolderIdentity), nil
+}
+
+func (l *fakeLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	l.record = &ler
+	return nil
+}
+
+func (l *fakeLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.failUpdates {
+		return errors.New("update refused")
+	}
+	l.record = &ler
+	return nil
+}
+
+func (l *fakeLock) holder() string {
+	l.Lock()
+	defer l.Unlock()
+	if l.record == nil {
+		return ""
+	}
+	return l.record.HolderIdentity
+}
+
+func (l *fakeLock) RecordEvent(string) {}
+
+func (l *fakeLock) Identity() string { return l.identity }
+
+func (l *fakeLock) Describe() string { return "fake/" + l.identity }
+
+// withShortLease makes the elections of a test take milliseconds
+func withShortLease(t *testing.T) {
+	saved := []time.Duration{leaseDuration, renewDeadline, retryPeriod}
+	leaseDuration, renewDeadline, retryPeriod = 300*time.Millisecond, 200*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() {
+		leaseDuration, renewDeadline, retryPeriod = saved[0], saved[1], saved[2]
+	})
+}
+
+// electLeader runs a leader election in the background and waits until run has been called
+func electLeader(t *testing.T, ctx context.Context, lock *fakeLock, run func(stopCh <-chan struct{}), lost func()) <-chan struct{} {
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		leaderelection.RunOrDie(ctx, leaderElectionConfig(ctx, lock, func(stopCh <-chan struct{}) {
+			close(started)
+			run(stopCh)
+		}, lost))
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership was not acquired")
+	}
+	return done
+}
+
+func TestLeaderElectionReleasesLeaseOnCancel(t *testing.T) {
+	withShortLease(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lock := &fakeLock{identity: "replica-1"}
+	stopped := make(chan struct{})
+	lostCalled := false
+	done := electLeader(t, ctx, lock, func(stopCh <-chan struct{}) {
+		<-stopCh
+		close(stopped)
+	}, func() { lostCalled = true })
+
+	if holder := lock.holder(); holder != "replica-1" {
+		t.Fatalf("expected replica-1 to hold the lease, got %q", holder)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader election did not return after cancel")
+	}
+	<-stopped
+
+	if lostCalled {
+		t.Error("expected giving up the lease on cancel not to count as losing it")
+	}
+	if holder := lock.holder(); holder != "" {
+		t.Errorf("expected the lease to be released, still held by %q", holder)
+	}
+}
+
+func TestLeaderElectionLostIsFatal(t *testing.T) {
+	withShortLease(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lock := &fakeLock{identity: "replica-1"}
+	lost := make(chan struct{})
+	done := electLeader(t, ctx, lock, func(stopCh <-chan struct{}) {
+		<-stopCh
+	}, func() { close(lost) })
+
+	// Another replica took the Lease, so renewals fail
+	lock.Lock()
+	lock.failUpdates = true
+	lock.Unlock()
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected losing the lease to call lost")
+	}
+	<-done
+}
+
+// The controller's cleanup runs after runWithLeaderElection returns, so it has to wait for run
+func TestRunWithLeaderElectionWaitsForRun(t *testing.T) {
+	withShortLease(t)
+	stopCh := make(chan struct{})
+	started := make(chan struct{})
+	finished := false
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		runWithLeaderElection(fake.NewSimpleClientset(), stopCh, func(stopCh <-chan struct{}) {
+			close(started)
+			<-stopCh
+			time.Sleep(100 * time.Millisecond)
+			finished = true
+		})
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership was not acquired")
+	}
+	close(stopCh)
+	<-returned
+	if !finished {
+		t.Errorf("Expected runWithLeaderElection to return after run")
+	}
+}
@@ -1,52 +1,176 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
-	kubeflow "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned"
 	informers "github.com/StatCan/kubeflow-controller/pkg/generated/informers/externalversions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/statcan/profile-state-controller/pkg/audit"
+	"github.com/statcan/profile-state-controller/pkg/auth"
+	"github.com/statcan/profile-state-controller/pkg/certs"
 	"github.com/statcan/profile-state-controller/pkg/controller"
 	"github.com/statcan/profile-state-controller/pkg/signals"
 	kubeinformers "k8s.io/client-go/informers"
-	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	masterURL  string
-	kubeconfig string
+	masterURL       string
+	kubeconfig      string
+	namespaceEvents bool
+	cleanupOrphans  bool
+	metricsAddr     string
+	healthAddr      string
+	stuckTimeout    time.Duration
+
+	webhookAddr           string
+	webhookCertFile       string
+	webhookKeyFile        string
+	webhookServiceAccount string
+	webhookAdminGroups    string
+	webhookSasWarnOnly    bool
+	webhookPVCExemptSAs   string
+
+	apiAddr         string
+	apiCertFile     string
+	apiKeyFile      string
+	apiAuth         bool
+	apiAuthGroup    string
+	apiAuthResource string
+	apiAuthVerb     string
+	apiAuthCacheTTL time.Duration
+
+	webhookCertSecret        string
+	webhookService           string
+	webhookConfigurations    string
+	webhookCertValidity      time.Duration
+	webhookCAValidity        time.Duration
+	webhookCertRotateBefore  time.Duration
+	webhookCertCheckInterval time.Duration
+
+	authzSensitiveNamespaces string
+	authzExceptionList       string
+	authzFailurePolicy       string
+
+	dryRun bool
+
+	historyNamespace string
+	historyLimit     int
+	historyRetention time.Duration
+
+	auditLog        string
+	auditMaxSize    int64
+	auditMaxAge     time.Duration
+	auditMaxBackups int
+	auditRetention  time.Duration
+	auditKeyFile    string
+
+	leaderElect             bool
+	leaderElectionID        string
+	leaderElectionNamespace string
+	leaseDuration           time.Duration
+	renewDeadline           time.Duration
+	retryPeriod             time.Duration
 )
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
-	flag.Parse()
+	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the Prometheus /metrics endpoint listens on.")
+	flag.StringVar(&healthAddr, "health-addr", ":8081", "The address the /healthz and /readyz probe endpoints listen on.")
+	flag.DurationVar(&stuckTimeout, "worker-stuck-timeout", 10*time.Minute, "How long workers may go without finishing a sync while items are queued before /healthz fails. 0 disables the check.")
+	flag.BoolVar(&namespaceEvents, "namespace-events", false, "Also record state transition Events against the Namespace.")
+	flag.BoolVar(&cleanupOrphans, "cleanup-orphaned-namespaces", false, "Remove the state labels from a Namespace whose Profile has been deleted.")
+	flag.BoolVar(&dryRun, "dry-run", false, "Compute the state labels and log the differences with the current labels, without writing labels or recording Events.")
+	flag.StringVar(&apiAddr, "api-addr", "", "The address the HTTPS API (/profiles, /report, /whatif, /openapi.json) listens on, for example :8082. The API is disabled when empty.")
+	flag.StringVar(&apiCertFile, "api-cert-file", "", "Path to the TLS certificate served by the API. Required with --api-addr.")
+	flag.StringVar(&apiKeyFile, "api-key-file", "", "Path to the TLS private key served by the API. Required with --api-addr.")
+	flag.BoolVar(&apiAuth, "api-auth", true, "Require a bearer token, checked with TokenReview, and authorize API requests with SubjectAccessReview.")
+	flag.StringVar(&apiAuthGroup, "api-auth-group", "state.aaw.statcan.gc.ca", "API group of the resource checked with SubjectAccessReview for API requests.")
+	flag.StringVar(&apiAuthResource, "api-auth-resource", "profilestates", "Resource checked with SubjectAccessReview for API requests, in the namespace being read.")
+	flag.StringVar(&apiAuthVerb, "api-auth-verb", "get", "Verb checked with SubjectAccessReview for API requests.")
+	flag.DurationVar(&apiAuthCacheTTL, "api-auth-cache-ttl", 10*time.Second, "How long token reviews and access decisions are cached.")
+	flag.StringVar(&webhookAddr, "webhook-addr", "", "The address the admission webhooks listen on, for example :8443. Webhooks are disabled when empty.")
+	flag.StringVar(&webhookCertFile, "webhook-cert-file", "/etc/webhook/certs/tls.crt", "Path to the TLS certificate served by the admission webhooks.")
+	flag.StringVar(&webhookKeyFile, "webhook-key-file", "/etc/webhook/certs/tls.key", "Path to the TLS private key served by the admission webhooks.")
+	flag.StringVar(&webhookServiceAccount, "webhook-service-account", "system:serviceaccount:statcan-system:profile-state-controller", "Username of the controller's ServiceAccount, which may change the state labels.")
+	flag.StringVar(&webhookAdminGroups, "webhook-admin-groups", "", "Comma-separated groups whose members may change the state labels.")
+	flag.BoolVar(&webhookSasWarnOnly, "webhook-sas-pods-warn-only", false, "Admit SAS pods that would be denied, returning a warning instead.")
+	flag.StringVar(&webhookPVCExemptSAs, "webhook-pvc-exempt-service-accounts", "", "Comma-separated ServiceAccount usernames that may create internal storage PVCs in namespaces with non-employees.")
+	flag.StringVar(&webhookCertSecret, "webhook-cert-secret", "", "Namespace/name of a Secret in which the controller generates and rotates its own webhook CA and certificate. When set, --webhook-cert-file and --webhook-key-file are ignored.")
+	flag.StringVar(&webhookService, "webhook-service", "statcan-system/profile-state-controller", "Namespace/name of the Service in front of the admission webhooks, used for the generated certificate's DNS names.")
+	flag.StringVar(&webhookConfigurations, "webhook-configurations", "profile-state-controller", "Comma-separated ValidatingWebhookConfigurations whose caBundle is set to the generated CA.")
+	flag.DurationVar(&webhookCertValidity, "webhook-cert-validity", 90*24*time.Hour, "How long generated webhook serving certificates are valid for.")
+	flag.DurationVar(&webhookCAValidity, "webhook-ca-validity", 5*365*24*time.Hour, "How long the generated webhook CA is valid for. The caBundle only changes when the CA is rotated.")
+	flag.DurationVar(&webhookCertRotateBefore, "webhook-cert-rotate-before", 30*24*time.Hour, "How long before expiry the generated webhook CA and serving certificates are rotated.")
+	flag.DurationVar(&webhookCertCheckInterval, "webhook-cert-check-interval", time.Hour, "How often the webhook certificate Secret is checked for expiry and rotations by other replicas.")
+	flag.StringVar(&historyNamespace, "history-namespace", "", "Namespace in which to keep a ConfigMap with the state transitions of each Profile. History is not kept when empty.")
+	flag.IntVar(&historyLimit, "history-limit", 200, "Number of state transitions kept per Profile.")
+	flag.DurationVar(&historyRetention, "history-retention", 90*24*time.Hour, "How long state transitions are kept.")
+	flag.StringVar(&auditLog, "audit-log", "", "Path of a JSON-lines file receiving one hash-chained record per sync. Auditing is disabled when empty.")
+	flag.Int64Var(&auditMaxSize, "audit-max-size", 100*1024*1024, "Size in bytes after which the audit log is rotated.")
+	flag.DurationVar(&auditMaxAge, "audit-max-age", 24*time.Hour, "Age after which the audit log is rotated.")
+	flag.IntVar(&auditMaxBackups, "audit-max-backups", 0, "Number of rotated audit logs kept. All of them are kept when 0.")
+	flag.DurationVar(&auditRetention, "audit-retention", 0, "Age after which rotated audit logs are removed. They are never removed by age when 0.")
+	flag.StringVar(&auditKeyFile, "audit-hmac-key-file", "", "Path of a file holding the key of the HMAC-SHA256 hashes of the audit log. Plain SHA-256 hashes are used when empty.")
+	flag.StringVar(&authzSensitiveNamespaces, "authz-webhook-sensitive-namespaces", controller.EXISTS_INTERNAL_BLOB_STORAGE+"=true", "Semicolon-separated label selectors of the namespaces whose resources the authorization webhook denies to non-employees.")
+	flag.StringVar(&authzExceptionList, "authz-webhook-exception-list", "sensitiveNamespaceExceptions", "List of the exceptions configuration whose users the authorization webhook treats as employees.")
+	flag.StringVar(&authzFailurePolicy, "authz-webhook-failure-policy", controller.AUTHORIZATION_FAILURE_POLICY_CLOSED, "What the authorization webhook does with a non-employee's request it cannot check: open (no opinion) or closed (deny).")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Use a Lease to elect a single active replica. Standby replicas keep their caches warm.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "profile-state-controller", "Name of the Lease used for leader election.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "statcan-system", "Namespace of the Lease used for leader election.")
+	flag.DurationVar(&leaseDuration, "leader-elect-lease-duration", 15*time.Second, "How long standby replicas wait before taking over an expired Lease.")
+	flag.DurationVar(&renewDeadline, "leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps retrying to renew the Lease before giving up leadership.")
+	flag.DurationVar(&retryPeriod, "leader-elect-retry-period", 2*time.Second, "How long replicas wait between attempts to acquire or renew the Lease.")
 }
 
 func main() {
-	stopCh := signals.SetupSignalHandler()
-
-	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
-	if err != nil {
-		log.Fatalf("error building kubeconfig: %v", err)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
 	}
 
-	kubeclient, err := kubernetes.NewForConfig(cfg)
-	if err != nil {
-		log.Fatalf("error building kubernetes clientset: %v", err)
-	}
+	stopCh := signals.SetupSignalHandler()
 
-	kubeflowclient, err := kubeflow.NewForConfig(cfg)
+	kubeclient, kubeflowclient, err := buildClients()
 	if err != nil {
-		log.Fatalf("error building kubeflow client: %v", err)
+		log.Fatal(err)
 	}
 
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeclient, time.Minute*5)
 	kubeflowInformerFactory := informers.NewSharedInformerFactory(kubeflowclient, time.Minute*5)
 
+	var auditSink *audit.Sink
+	if auditLog != "" {
+		key, err := readAuditKey(auditKeyFile)
+		if err != nil {
+			log.Fatalf("error reading the audit key: %v", err)
+		}
+		auditSink, err = audit.Open(audit.Options{
+			Path:       auditLog,
+			MaxSize:    auditMaxSize,
+			MaxAge:     auditMaxAge,
+			MaxBackups: auditMaxBackups,
+			Retention:  auditRetention,
+			Key:        key,
+		})
+		if err != nil {
+			log.Fatalf("error opening audit log: %v", err)
+		}
+		defer auditSink.Close()
+	}
+
+	if err := controller.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("error registering metrics: %v", err)
+	}
+
 	ctlr := controller.NewController(
 		kubeclient,
 		kubeflowclient,
@@ -55,12 +179,152 @@ func main() {
 		kubeInformerFactory.Core().V1().Pods(),
 		kubeInformerFactory.Rbac().V1().RoleBindings(),
 		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		controller.Options{
+			RecordNamespaceEvents:     namespaceEvents,
+			WorkerStuckTimeout:        stuckTimeout,
+			LeaderElection:            leaderElect,
+			CleanupOrphanedNamespaces: cleanupOrphans,
+			DryRun:                    dryRun,
+			HistoryNamespace:          historyNamespace,
+			HistoryLimit:              historyLimit,
+			HistoryRetention:          historyRetention,
+			AuditLog:                  auditSink,
+		},
 	)
 
+	if err := ctlr.RegisterStateMetrics(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("error registering profile state metrics: %v", err)
+	}
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+			log.Fatalf("error serving metrics: %v", err)
+		}
+	}()
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", ctlr.Healthz)
+		mux.HandleFunc("/readyz", ctlr.Readyz)
+		if err := http.ListenAndServe(healthAddr, mux); err != nil {
+			log.Fatalf("error serving health probes: %v", err)
+		}
+	}()
+
+	if apiAddr != "" {
+		// The API takes bearer tokens and returns email addresses, so it is only served over TLS
+		if apiCertFile == "" || apiKeyFile == "" {
+			log.Fatalf("--api-addr requires --api-cert-file and --api-key-file")
+		}
+		var authorizer controller.Authorizer
+		if apiAuth {
+			authorizer = auth.NewAuthorizer(kubeclient, auth.Options{
+				Group:    apiAuthGroup,
+				Resource: apiAuthResource,
+				Verb:     apiAuthVerb,
+				CacheTTL: apiAuthCacheTTL,
+			})
+		}
+		go func() {
+			if err := http.ListenAndServeTLS(apiAddr, apiCertFile, apiKeyFile, ctlr.APIHandler(authorizer)); err != nil {
+				log.Fatalf("error serving API: %v", err)
+			}
+		}()
+	}
+
+	if webhookAddr != "" {
+		selectors, err := controller.ParseSensitiveNamespaceSelectors(authzSensitiveNamespaces)
+		if err != nil {
+			log.Fatalf("error parsing --authz-webhook-sensitive-namespaces: %v", err)
+		}
+		failClosed, err := controller.ParseAuthorizationFailurePolicy(authzFailurePolicy)
+		if err != nil {
+			log.Fatalf("error parsing --authz-webhook-failure-policy: %v", err)
+		}
+		webhook := controller.NewWebhook(ctlr, controller.WebhookOptions{
+			ServiceAccount:             webhookServiceAccount,
+			AdminGroups:                splitList(webhookAdminGroups),
+			SasPodWarnOnly:             webhookSasWarnOnly,
+			InternalPVCServiceAccounts: splitList(webhookPVCExemptSAs),
+
+			SensitiveNamespaceSelectors:     selectors,
+			SensitiveNamespaceExceptionList: authzExceptionList,
+			AuthorizationFailClosed:         failClosed,
+		})
+		server := &http.Server{Addr: webhookAddr, Handler: webhook.Handler()}
+		certFile, keyFile := webhookCertFile, webhookKeyFile
+		if webhookCertSecret != "" {
+			manager := certs.NewManager(kubeclient, webhookCertOptions())
+			if err := manager.Start(stopCh); err != nil {
+				log.Fatalf("error bootstrapping webhook certificates: %v", err)
+			}
+			server.TLSConfig = &tls.Config{GetCertificate: manager.GetCertificate}
+			certFile, keyFile = "", ""
+		}
+		go func() {
+			if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+				log.Fatalf("error serving admission webhooks: %v", err)
+			}
+		}()
+	}
+
 	kubeInformerFactory.Start(stopCh)
 	kubeflowInformerFactory.Start(stopCh)
 
-	if err = ctlr.Run(2, stopCh); err != nil {
-		log.Fatalf("error running controller: %v", err)
+	run := func(stopCh <-chan struct{}) {
+		if err := ctlr.Run(2, stopCh); err != nil {
+			log.Fatalf("error running controller: %v", err)
+		}
+	}
+
+	if !leaderElect {
+		run(stopCh)
+		return
+	}
+	runWithLeaderElection(kubeclient, stopCh, run)
+}
+
+// webhookCertOptions builds the certificate manager options from the webhook flags
+func webhookCertOptions() certs.Options {
+	secretNamespace, secretName := splitNamespacedName(webhookCertSecret)
+	serviceNamespace, serviceName := splitNamespacedName(webhookService)
+	if webhookCertValidity <= webhookCertRotateBefore {
+		log.Fatalf("--webhook-cert-validity must be longer than --webhook-cert-rotate-before")
+	}
+	if webhookCAValidity <= webhookCertValidity {
+		log.Fatalf("--webhook-ca-validity must be longer than --webhook-cert-validity")
+	}
+	return certs.Options{
+		SecretNamespace:       secretNamespace,
+		SecretName:            secretName,
+		ServiceNamespace:      serviceNamespace,
+		ServiceName:           serviceName,
+		WebhookConfigurations: splitList(webhookConfigurations),
+		Validity:              webhookCertValidity,
+		CAValidity:            webhookCAValidity,
+		RotateBefore:          webhookCertRotateBefore,
+		CheckInterval:         webhookCertCheckInterval,
+	}
+}
+
+// splitNamespacedName parses a namespace/name flag value
+func splitNamespacedName(value string) (string, string) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		log.Fatalf("expected namespace/name but got %q", value)
+	}
+	return parts[0], parts[1]
+}
+
+// splitList parses a comma-separated flag value, ignoring empty entries
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -0,0 +1,431 @@
+// Package audit appends one JSON record per controller sync to a file, separately from the logs.
+// Each record holds the hash of the previous one, so that a record that is edited, removed or
+// inserted breaks the chain, which Verify detects. With a key the hashes are HMACs, so that the
+// chain cannot be rewritten without the key, and the newest hash is logged periodically, so that
+// records removed from the end can be detected. Files are rotated by size and by age, the chain
+// continues across rotated files, and old rotated files can be removed.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Layout of the timestamp appended to rotated files, which sorts in time order
+const rotatedLayout = "20060102T150405.000000000Z"
+
+// HEAD_LOG_INTERVAL is how often the hash of the newest record is logged
+const HEAD_LOG_INTERVAL = time.Hour
+
+// Inputs summarises the objects a sync looked at
+type Inputs struct {
+	Pods                   int `json:"pods"`
+	RoleBindings           int `json:"roleBindings"`
+	PersistentVolumeClaims int `json:"persistentVolumeClaims"`
+	// Users are the User subjects of the RoleBindings
+	Users []string `json:"users"`
+}
+
+// Write is a write of state labels to a Profile or a Namespace
+type Write struct {
+	Resource string            `json:"resource"`
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Removed  []string          `json:"removed,omitempty"`
+}
+
+// Record describes one sync of a Profile
+type Record struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Profile  string    `json:"profile"`
+	Trigger  string    `json:"trigger"`
+	// Deleted is true when the Profile no longer exists
+	Deleted bool              `json:"deleted"`
+	DryRun  bool              `json:"dryRun"`
+	Inputs  *Inputs           `json:"inputs,omitempty"`
+	State   map[string]string `json:"state,omitempty"`
+	Written []Write           `json:"written"`
+	Error   string            `json:"error,omitempty"`
+
+	// PreviousHash is the Hash of the previous record, empty for the first record
+	PreviousHash string `json:"previousHash"`
+	// Hash is the SHA-256 of the record encoded without its Hash, or its HMAC-SHA256 with a key
+	Hash string `json:"hash"`
+}
+
+// hash computes the Hash of a record, as an HMAC when a key is given
+func (r Record) hash(key []byte) (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Options configures the file and its rotation
+type Options struct {
+	// Path of the file records are appended to
+	Path string
+
+	// MaxSize rotates the file before it grows beyond this number of bytes, when positive
+	MaxSize int64
+
+	// MaxAge rotates the file once its first record is older than this, when positive
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files kept, the oldest being removed first, when positive
+	MaxBackups int
+
+	// Retention removes the rotated files older than this, when positive
+	Retention time.Duration
+
+	// Key makes the hashes HMACs, when set
+	Key []byte
+}
+
+// Sink appends records to the audit file
+type Sink struct {
+	mutex   sync.Mutex
+	options Options
+	now     func() time.Time
+
+	file     *os.File
+	size     int64
+	started  time.Time
+	sequence uint64
+	lastHash string
+
+	headLogged time.Time
+}
+
+// Open opens the audit file for appending, continuing the chain of the records it already holds.
+// A last record that was only partly written, because the controller stopped while writing it,
+// is set aside.
+func Open(options Options) (*Sink, error) {
+	s := &Sink{options: options, now: time.Now}
+	if err := setAsideTornRecord(options.Path, s.now()); err != nil {
+		return nil, err
+	}
+
+	files, err := Files(options.Path)
+	if err != nil {
+		return nil, err
+	}
+	// The last record may be in a rotated file when the current one is empty
+	for i := len(files) - 1; i >= 0 && s.lastHash == ""; i-- {
+		first, last, err := boundaryRecords(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			s.sequence, s.lastHash = last.Sequence, last.Hash
+		}
+		if files[i] == options.Path && first != nil {
+			s.started = first.Time
+		}
+	}
+
+	if err := s.openFile(); err != nil {
+		return nil, err
+	}
+	if err := s.removeOldFiles(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setAsideTornRecord moves what follows the last newline of a file to a file with a .torn
+// suffix, keeping the complete records only
+func setAsideTornRecord(path string, now time.Time) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == len(data) {
+		return nil
+	}
+
+	torn := fmt.Sprintf("%s.%s.torn", path, now.UTC().Format(rotatedLayout))
+	log.Warnf("the last record of audit log %s is incomplete, moving its %d bytes to %s", path, len(data)-end, torn)
+	if err := ioutil.WriteFile(torn, data[end:], 0600); err != nil {
+		return err
+	}
+	return os.Truncate(path, int64(end))
+}
+
+func (s *Sink) openFile() error {
+	file, err := os.OpenFile(s.options.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// Write completes a record with its sequence number, time and hashes, and appends it
+func (s *Sink) Write(record Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record.Sequence = s.sequence + 1
+	record.Time = s.now().UTC()
+	record.PreviousHash = s.lastHash
+	hash, err := record.hash(s.options.Key)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.size > 0 && s.shouldRotate(int64(len(line)), record.Time) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if s.size == 0 {
+		s.started = record.Time
+	}
+	s.size += int64(len(line))
+	s.sequence, s.lastHash = record.Sequence, record.Hash
+
+	if record.Time.Sub(s.headLogged) >= HEAD_LOG_INTERVAL {
+		s.logHead()
+	}
+	return nil
+}
+
+// logHead logs the sequence and hash of the newest record, which `audit verify --head` checks
+func (s *Sink) logHead() {
+	log.WithFields(log.Fields{"sequence": s.sequence, "hash": s.lastHash}).Infof("audit log %s head", s.options.Path)
+	s.headLogged = s.now().UTC()
+}
+
+func (s *Sink) shouldRotate(size int64, now time.Time) bool {
+	if s.options.MaxSize > 0 && s.size+size > s.options.MaxSize {
+		return true
+	}
+	return s.options.MaxAge > 0 && now.Sub(s.started) >= s.options.MaxAge
+}
+
+// rotate renames the current file with a timestamp and starts a new one
+func (s *Sink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", s.options.Path, s.now().UTC().Format(rotatedLayout))
+	if err := os.Rename(s.options.Path, rotated); err != nil {
+		return err
+	}
+	s.logHead()
+	if err := s.openFile(); err != nil {
+		return err
+	}
+	return s.removeOldFiles()
+}
+
+// removeOldFiles removes the rotated files older than the retention, then the oldest rotated
+// files beyond MaxBackups
+func (s *Sink) removeOldFiles() error {
+	files, err := Files(s.options.Path)
+	if err != nil {
+		return err
+	}
+	rotated := []string{}
+	for _, file := range files {
+		if file != s.options.Path {
+			rotated = append(rotated, file)
+		}
+	}
+
+	remove := 0
+	for s.options.Retention > 0 && remove < len(rotated) {
+		at, _ := time.Parse(rotatedLayout, rotated[remove][len(s.options.Path)+1:])
+		if s.now().Sub(at) <= s.options.Retention {
+			break
+		}
+		remove++
+	}
+	if s.options.MaxBackups > 0 && len(rotated)-remove > s.options.MaxBackups {
+		remove = len(rotated) - s.options.MaxBackups
+	}
+	for _, file := range rotated[:remove] {
+		log.Infof("removing rotated audit log %s", file)
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close logs the newest record and closes the audit file
+func (s *Sink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sequence > 0 {
+		s.logHead()
+	}
+	return s.file.Close()
+}
+
+// Files lists the rotated files of an audit file, oldest first, followed by the file itself
+// when it exists
+func Files(path string) ([]string, error) {
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range rotated {
+		if _, err := time.Parse(rotatedLayout, file[len(path)+1:]); err == nil {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// boundaryRecords returns the first and last records of a file, or nil when it has none
+func boundaryRecords(path string) (*Record, *Record, error) {
+	var first, last *Record
+	err := readRecords(path, func(record *Record) error {
+		if first == nil {
+			first = record
+		}
+		last = record
+		return nil
+	})
+	return first, last, err
+}
+
+// readRecords decodes every line of a file, rejecting fields that are not part of a Record
+func readRecords(path string, read func(*Record) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			record := &Record{}
+			if err := decoder.Decode(record); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			if err := read(record); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// VerifyOptions configures the checks of Verify
+type VerifyOptions struct {
+	// Key is the key of the HMACs, when the records were written with one
+	Key []byte
+
+	// Pruned accepts a first record after sequence 1, when old rotated files were removed
+	Pruned bool
+
+	// Head is the hash of a record logged by the Sink, which must be part of the chain when set
+	Head string
+}
+
+// Verify checks the hash of every record of the files, in order, and that each record follows
+// the previous one. The first record must start the chain unless options.Pruned is set.
+// It returns the number of records checked.
+func Verify(files []string, options VerifyOptions) (int, error) {
+	count := 0
+	headFound := false
+	var previous *Record
+	for _, path := range files {
+		err := readRecords(path, func(record *Record) error {
+			hash, err := record.hash(options.Key)
+			if err != nil {
+				return err
+			}
+			if hash != record.Hash {
+				return fmt.Errorf("record %d was modified: its hash is %s but its content hashes to %s", record.Sequence, record.Hash, hash)
+			}
+			if previous != nil {
+				if record.PreviousHash != previous.Hash {
+					return fmt.Errorf("record %d does not follow record %d: the chain is broken", record.Sequence, previous.Sequence)
+				}
+				if record.Sequence != previous.Sequence+1 {
+					return fmt.Errorf("record %d follows record %d: records are missing", record.Sequence, previous.Sequence)
+				}
+			} else if record.Sequence == 1 && record.PreviousHash != "" {
+				return fmt.Errorf("record 1 has a previous hash: the chain is broken")
+			} else if record.Sequence != 1 && !options.Pruned {
+				return fmt.Errorf("the first record is %d: records 1 to %d are missing", record.Sequence, record.Sequence-1)
+			}
+			headFound = headFound || record.Hash == options.Head
+			previous = record
+			count++
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	if options.Head != "" && !headFound {
+		return count, fmt.Errorf("no record has the hash %s: records are missing at the end", options.Head)
+	}
+	return count, nil
+}
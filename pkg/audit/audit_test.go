@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestSink(t *testing.T, path string, options Options, now *time.Time) *Sink {
+	options.Path = path
+	sink, err := Open(options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	sink.now = func() time.Time { return *now }
+	return sink
+}
+
+func writeRecords(t *testing.T, sink *Sink, now *time.Time, count int) {
+	for i := 0; i < count; i++ {
+		record := Record{
+			Profile: "alice",
+			Trigger: "Pod alice/notebook-0",
+			Inputs:  &Inputs{Pods: 1, RoleBindings: 1, Users: []string{"alice@statcan.gc.ca"}},
+			State:   map[string]string{"state.aaw.statcan.gc.ca/has-sas-notebook-feature": "true"},
+			Written: []Write{{Resource: "profile", Name: "alice", Labels: map[string]string{"state.aaw.statcan.gc.ca/has-sas-notebook-feature": "true"}}},
+		}
+		if err := sink.Write(record); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		*now = now.Add(time.Minute)
+	}
+}
+
+func verifyPath(t *testing.T, path string) (int, error) {
+	return verifyPathWith(t, path, VerifyOptions{})
+}
+
+func verifyPathWith(t *testing.T, path string, options VerifyOptions) (int, error) {
+	files, err := Files(path)
+	if err != nil {
+		t.Fatalf("Files failed: %v", err)
+	}
+	return Verify(files, options)
+}
+
+func TestChainContinuesAfterReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	sink := openTestSink(t, path, Options{}, &now)
+	writeRecords(t, sink, &now, 3)
+	sink.Close()
+
+	sink = openTestSink(t, path, Options{}, &now)
+	writeRecords(t, sink, &now, 2)
+	sink.Close()
+
+	if count, err := verifyPath(t, path); err != nil || count != 5 {
+		t.Fatalf("Expected 5 intact records but got %d: %v", count, err)
+	}
+}
+
+func TestRotationBySizeAndAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// Each record is a few hundred bytes, so every second record starts a new file
+	sink := openTestSink(t, path, Options{MaxSize: 1000}, &now)
+	writeRecords(t, sink, &now, 6)
+	sink.Close()
+	files, _ := Files(path)
+	if len(files) < 3 {
+		t.Fatalf("Expected the audit log to be rotated by size, got %v", files)
+	}
+
+	sink = openTestSink(t, path, Options{MaxAge: time.Hour}, &now)
+	now = now.Add(2 * time.Hour)
+	writeRecords(t, sink, &now, 1)
+	sink.Close()
+	if rotated, _ := Files(path); len(rotated) != len(files)+1 {
+		t.Fatalf("Expected the audit log to be rotated by age, got %v", rotated)
+	}
+
+	if count, err := verifyPath(t, path); err != nil || count != 7 {
+		t.Fatalf("Expected 7 intact records across the rotated files but got %d: %v", count, err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tamper func(lines []string) []string
+		error  string
+	}{
+		{"edited record", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"profile":"alice"`, `"profile":"bob"`, 1)
+			return lines
+		}, "was modified"},
+		{"removed record", func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}, "chain is broken"},
+		{"removed first record", func(lines []string) []string {
+			return lines[1:]
+		}, "records 1 to 1 are missing"},
+		{"added field", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `{"sequence"`, `{"note":"x","sequence"`, 1)
+			return lines
+		}, "unknown field"},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+		sink := openTestSink(t, path, Options{}, &now)
+		writeRecords(t, sink, &now, 3)
+		sink.Close()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read the audit log: %v", err)
+		}
+		lines := test.tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+		if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatalf("Failed to write the audit log: %v", err)
+		}
+
+		if _, err := verifyPath(t, path); err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%s: expected an error containing %q but got %v", test.name, test.error, err)
+		}
+	}
+}
+
+// A record that was only partly written when the controller stopped is set aside on restart
+func TestOpenSetsAsideTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	sink := openTestSink(t, path, Options{}, &now)
+	writeRecords(t, sink, &now, 3)
+	sink.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Failed to open the audit log: %v", err)
+	}
+	file.WriteString(`{"sequence":4,"time":"2022-06-01T12:03:00Z","prof`)
+	file.Close()
+
+	sink = openTestSink(t, path, Options{}, &now)
+	writeRecords(t, sink, &now, 1)
+	sink.Close()
+
+	if count, err := verifyPath(t, path); err != nil || count != 4 {
+		t.Fatalf("Expected 4 intact records but got %d: %v", count, err)
+	}
+	if torn, _ := filepath.Glob(path + ".*.torn"); len(torn) != 1 {
+		t.Fatalf("Expected the torn record to be set aside but got %v", torn)
+	}
+}
+
+func TestRemoveOldFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	sink := openTestSink(t, path, Options{MaxSize: 1000, MaxBackups: 2}, &now)
+	writeRecords(t, sink, &now, 10)
+	sink.Close()
+	if files, _ := Files(path); len(files) != 3 {
+		t.Fatalf("Expected 2 rotated files and the audit log but got %v", files)
+	}
+
+	now = now.Add(2 * time.Hour)
+	sink = openTestSink(t, path, Options{Retention: time.Hour}, &now)
+	sink.Close()
+	if files, _ := Files(path); len(files) != 1 || files[0] != path {
+		t.Fatalf("Expected only the audit log after the retention but got %v", files)
+	}
+
+	if _, err := verifyPath(t, path); err == nil || !strings.Contains(err.Error(), "are missing") {
+		t.Fatalf("Expected the removed records to be reported but got %v", err)
+	}
+	if _, err := verifyPathWith(t, path, VerifyOptions{Pruned: true}); err != nil {
+		t.Fatalf("Expected the remaining records to be intact: %v", err)
+	}
+}
+
+func TestVerifyWithKeyAndHead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	key := []byte("secret")
+	sink := openTestSink(t, path, Options{Key: key}, &now)
+	writeRecords(t, sink, &now, 3)
+	head := sink.lastHash
+	sink.Close()
+
+	if count, err := verifyPathWith(t, path, VerifyOptions{Key: key, Head: head}); err != nil || count != 3 {
+		t.Fatalf("Expected 3 intact records but got %d: %v", count, err)
+	}
+	if _, err := verifyPath(t, path); err == nil || !strings.Contains(err.Error(), "was modified") {
+		t.Fatalf("Expected records written with a key not to verify without it but got %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines[:2], "\n")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the audit log: %v", err)
+	}
+	if _, err := verifyPathWith(t, path, VerifyOptions{Key: key, Head: head}); err == nil || !strings.Contains(err.Error(), "missing at the end") {
+		t.Fatalf("Expected the removed newest record to be reported but got %v", err)
+	}
+}
+
+func TestFilesIgnoresOtherFiles(t *testing.T) {
+	directory := t.TempDir()
+	path := filepath.Join(directory, "audit.jsonl")
+	for _, name := range []string{"audit.jsonl", "audit.jsonl.20220601T120000.000000000Z", "audit.jsonl.bak"} {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), nil, 0600); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+	files, err := Files(path)
+	if err != nil || len(files) != 2 || files[1] != path {
+		t.Fatalf("Expected the rotated file then the audit log but got %v %v", files, err)
+	}
+	os.Remove(path)
+	if files, _ := Files(path); len(files) != 1 {
+		t.Fatalf("Expected only the rotated file once the audit log is gone but got %v", files)
+	}
+}
@@ -0,0 +1,176 @@
+// Package auth protects the controller's HTTP endpoints. Callers authenticate with a bearer
+// token checked through the TokenReview API, and are authorized per namespace through the
+// SubjectAccessReview API, so access follows the cluster's own RBAC.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Maximum number of tokens and decisions kept in each cache
+const cacheSize = 4096
+
+// Options configures the resource attributes checked for every request and the cache duration
+type Options struct {
+	// Group, Resource and Verb are checked with a SubjectAccessReview, for example
+	// get profilestates.state.aaw.statcan.gc.ca. The namespace of the request is added.
+	Group    string
+	Resource string
+	Verb     string
+
+	// CacheTTL is how long token reviews and access decisions are reused
+	CacheTTL time.Duration
+}
+
+// Authorizer authenticates the callers of an HTTP handler and authorizes their access to namespaces
+type Authorizer struct {
+	client  kubernetes.Interface
+	options Options
+
+	tokens    *cache.LRUExpireCache
+	decisions *cache.LRUExpireCache
+}
+
+type contextKey struct{}
+
+// NewAuthorizer creates an Authorizer that calls the TokenReview and SubjectAccessReview APIs
+func NewAuthorizer(client kubernetes.Interface, options Options) *Authorizer {
+	return &Authorizer{
+		client:    client,
+		options:   options,
+		tokens:    cache.NewLRUExpireCache(cacheSize),
+		decisions: cache.NewLRUExpireCache(cacheSize),
+	}
+}
+
+// Authenticate rejects requests without a valid bearer token, and passes the others on with
+// the caller's identity in their context
+func (a *Authorizer) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := a.reviewToken(r.Context(), token)
+		if err != nil {
+			log.Errorf("failed to review token: %v", err)
+			http.Error(w, "failed to authenticate", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+	})
+}
+
+// User returns the identity of the caller stored by Authenticate
+func User(r *http.Request) (*authenticationv1.UserInfo, bool) {
+	user, ok := r.Context().Value(contextKey{}).(*authenticationv1.UserInfo)
+	return user, ok
+}
+
+// Caller returns the username and groups of the caller of an authenticated request
+func (a *Authorizer) Caller(r *http.Request) (string, []string, bool) {
+	user, ok := User(r)
+	if !ok {
+		return "", nil, false
+	}
+	return user.Username, user.Groups, true
+}
+
+// Authorized returns whether the caller of an authenticated request may read the given
+// namespace. An empty namespace asks for access to every namespace.
+func (a *Authorizer) Authorized(r *http.Request, namespace string) (bool, error) {
+	user, ok := User(r)
+	if !ok {
+		return false, nil
+	}
+
+	key := decisionKey(user, namespace)
+	if allowed, ok := a.decisions.Get(key); ok {
+		return allowed.(bool), nil
+	}
+
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      a.options.Verb,
+				Group:     a.options.Group,
+				Resource:  a.options.Resource,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	allowed := review.Status.Allowed && !review.Status.Denied
+	a.decisions.Add(key, allowed, a.options.CacheTTL)
+	return allowed, nil
+}
+
+// reviewToken returns the user a token belongs to, or nil when the token is not valid
+func (a *Authorizer) reviewToken(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	// Only a hash of the token is kept in memory
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if user, ok := a.tokens.Get(key); ok {
+		return user.(*authenticationv1.UserInfo), nil
+	}
+
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var user *authenticationv1.UserInfo
+	if review.Status.Authenticated {
+		user = &review.Status.User
+	}
+	a.tokens.Add(key, user, a.options.CacheTTL)
+	return user, nil
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[len("Bearer "):])
+}
+
+// decisionKey identifies an access decision by everything the SubjectAccessReview depends on
+func decisionKey(user *authenticationv1.UserInfo, namespace string) string {
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%v\x00%s", user.Username, user.UID, strings.Join(user.Groups, ","), user.Extra, namespace)
+}
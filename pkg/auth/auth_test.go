@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testOptions = Options{
+	Group:    "state.aaw.statcan.gc.ca",
+	Resource: "profilestates",
+	Verb:     "get",
+	CacheTTL: time.Minute,
+}
+
+// newFakeClient answers TokenReviews for the token sam-token, and SubjectAccessReviews that
+// allow sam@statcan.gc.ca in namespace sam. It counts the reviews of each kind.
+func newFakeClient(reviews map[string]int) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews["tokenreviews"]++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "sam-token" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "sam@statcan.gc.ca", Groups: []string{"system:authenticated"}}
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews["subjectaccessreviews"]++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "sam@statcan.gc.ca" && attributes.Namespace == "sam" &&
+			attributes.Verb == "get" && attributes.Resource == "profilestates" && attributes.Group == "state.aaw.statcan.gc.ca"
+		return true, review, nil
+	})
+	return client
+}
+
+// serve sends a request with a token through Authenticate, and reports the access to namespace
+func serve(authorizer *Authorizer, token string, namespace string) (int, bool) {
+	allowed := false
+	handler := authorizer.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, _ = authorizer.Authorized(r, namespace)
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/profiles", nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Code, allowed
+}
+
+func TestAuthenticateRejectsMissingAndInvalidTokens(t *testing.T) {
+	authorizer := NewAuthorizer(newFakeClient(map[string]int{}), testOptions)
+	if code, _ := serve(authorizer, "", "sam"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token but got %d", code)
+	}
+	if code, _ := serve(authorizer, "forged-token", "sam"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with an invalid token but got %d", code)
+	}
+}
+
+func TestAuthorizedChecksTheNamespace(t *testing.T) {
+	authorizer := NewAuthorizer(newFakeClient(map[string]int{}), testOptions)
+	if code, allowed := serve(authorizer, "sam-token", "sam"); code != http.StatusOK || !allowed {
+		t.Fatalf("Expected sam to read namespace sam, got %d %t", code, allowed)
+	}
+	if _, allowed := serve(authorizer, "sam-token", "bob"); allowed {
+		t.Fatalf("Expected sam not to read namespace bob")
+	}
+	if _, allowed := serve(authorizer, "sam-token", ""); allowed {
+		t.Fatalf("Expected sam not to read every namespace")
+	}
+}
+
+func TestReviewsAreCached(t *testing.T) {
+	reviews := map[string]int{}
+	authorizer := NewAuthorizer(newFakeClient(reviews), testOptions)
+	for i := 0; i < 3; i++ {
+		serve(authorizer, "sam-token", "sam")
+	}
+	if reviews["tokenreviews"] != 1 || reviews["subjectaccessreviews"] != 1 {
+		t.Fatalf("Expected one review of each kind but got %v", reviews)
+	}
+}
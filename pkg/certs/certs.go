@@ -0,0 +1,391 @@
+// Package certs bootstraps and rotates the TLS certificate served by the admission webhooks,
+// without depending on cert-manager. The CA and serving certificate live in a Secret that all
+// replicas share, and the CA is published in the caBundle of the webhook configurations. The CA
+// is long-lived and the serving certificate is rotated on its own, so the caBundle only changes
+// when the CA itself nears expiry.
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Keys of the Secret holding the certificates
+const (
+	CACertKey = "ca.crt"
+	CAKeyKey  = "ca.key"
+	// CABundleKey holds the CAs that clients should trust, which includes the previous CA
+	// for a while after a rotation
+	CABundleKey = "ca-bundle.crt"
+)
+
+// Options configures the certificate Manager
+type Options struct {
+	// SecretNamespace and SecretName locate the Secret shared by all replicas
+	SecretNamespace string
+	SecretName      string
+
+	// ServiceNamespace and ServiceName are used to build the DNS names of the serving certificate
+	ServiceNamespace string
+	ServiceName      string
+
+	// WebhookConfigurations lists the ValidatingWebhookConfigurations whose caBundle is kept up to date
+	WebhookConfigurations []string
+
+	// Validity is how long new serving certificates are valid for
+	Validity time.Duration
+
+	// CAValidity is how long a new CA is valid for. It should be much longer than Validity.
+	CAValidity time.Duration
+
+	// RotateBefore is how long before expiry the CA and serving certificate are replaced
+	RotateBefore time.Duration
+
+	// CheckInterval is how often the Secret is checked for expiry and for rotations done by other replicas
+	CheckInterval time.Duration
+}
+
+// Manager keeps the serving certificate in memory and in sync with the Secret
+type Manager struct {
+	client  kubernetes.Interface
+	options Options
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// NewManager creates a certificate Manager
+func NewManager(client kubernetes.Interface, options Options) *Manager {
+	return &Manager{
+		client:  client,
+		options: options,
+	}
+}
+
+// Start makes sure a valid certificate exists before returning, then keeps checking it
+// in the background until stopCh is closed.
+func (m *Manager) Start(stopCh <-chan struct{}) error {
+	if err := m.Reconcile(context.Background()); err != nil {
+		return err
+	}
+	go wait.Until(func() {
+		if err := m.Reconcile(context.Background()); err != nil {
+			log.Errorf("failed to reconcile webhook certificates: %v", err)
+		}
+	}, m.options.CheckInterval, stopCh)
+	return nil
+}
+
+// GetCertificate serves the current certificate, for use in tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.certificate == nil {
+		return nil, fmt.Errorf("webhook certificate is not loaded yet")
+	}
+	return m.certificate, nil
+}
+
+// Reconcile creates or rotates the certificates in the Secret when needed, publishes the CA
+// bundle to the webhook configurations and then loads the serving certificate.
+func (m *Manager) Reconcile(ctx context.Context) error {
+	secret, err := m.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("failed to load serving certificate from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+	}
+
+	// The API server must trust a new CA before certificates it signed are served. Until the
+	// bundle is published, the previous certificate is served, which the bundle still trusts.
+	for _, name := range m.options.WebhookConfigurations {
+		if err := m.patchCABundle(ctx, name, secret.Data[CABundleKey]); err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	m.certificate = &certificate
+	m.mutex.Unlock()
+	return nil
+}
+
+// ensureSecret returns a Secret holding valid certificates. Replicas coordinate through the
+// API server: only one create or update of a given version can succeed, and the others
+// read back what the winner wrote.
+func (m *Manager) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	secrets := m.client.CoreV1().Secrets(m.options.SecretNamespace)
+
+	for attempt := 0; attempt < 5; attempt++ {
+		secret, err := secrets.Get(ctx, m.options.SecretName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      m.options.SecretName,
+					Namespace: m.options.SecretNamespace,
+				},
+				Type: corev1.SecretTypeTLS,
+			}
+			if secret.Data, err = m.generate(nil); err != nil {
+				return nil, err
+			}
+			created, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				continue
+			}
+			if err == nil {
+				log.Infof("created webhook certificates in secret %s/%s", secret.Namespace, secret.Name)
+			}
+			return created, err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !m.needsRotation(secret.Data) {
+			return secret, nil
+		}
+
+		updated := secret.DeepCopy()
+		if updated.Data, err = m.generate(secret.Data); err != nil {
+			return nil, err
+		}
+		result, err := secrets.Update(ctx, updated, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			// Another replica rotated the certificates first
+			continue
+		}
+		if err == nil {
+			log.Infof("rotated webhook certificates in secret %s/%s", secret.Namespace, secret.Name)
+		}
+		return result, err
+	}
+
+	return nil, fmt.Errorf("failed to create or rotate secret %s/%s after repeated conflicts", m.options.SecretNamespace, m.options.SecretName)
+}
+
+// needsRotation returns true when the Secret is incomplete, the CA or the serving certificate
+// expires soon, or the serving certificate was not signed by the CA
+func (m *Manager) needsRotation(data map[string][]byte) bool {
+	for _, key := range []string{CABundleKey, corev1.TLSPrivateKeyKey} {
+		if len(data[key]) == 0 {
+			return true
+		}
+	}
+	ca, _, err := parseCA(data)
+	if err != nil || m.expiresSoon(ca) {
+		return true
+	}
+	serving, err := parseCertificate(data[corev1.TLSCertKey])
+	if err != nil || m.expiresSoon(serving) {
+		return true
+	}
+	return serving.CheckSignatureFrom(ca) != nil
+}
+
+func (m *Manager) expiresSoon(certificate *x509.Certificate) bool {
+	return time.Until(certificate.NotAfter) < m.options.RotateBefore
+}
+
+// dnsNames lists the names under which the API server reaches the webhook Service
+func (m *Manager) dnsNames() []string {
+	service := m.options.ServiceName
+	namespace := m.options.ServiceNamespace
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+// generate issues a new serving certificate. The CA of the previous Secret data is kept unless
+// it is missing or expires soon, in which case a new CA is created. The bundle keeps the previous
+// CAs until they expire, so that clients using an older caBundle keep working during a rotation.
+func (m *Manager) generate(previous map[string][]byte) (map[string][]byte, error) {
+	now := time.Now()
+
+	caPEM, caKeyPEM := previous[CACertKey], previous[CAKeyKey]
+	caCert, caKey, err := parseCA(previous)
+	if err != nil || m.expiresSoon(caCert) {
+		if caPEM, caKeyPEM, err = m.generateCA(now); err != nil {
+			return nil, err
+		}
+		caCert, caKey, err = parseCA(map[string][]byte{CACertKey: caPEM, CAKeyKey: caKeyPEM})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A serving certificate is never valid for longer than its CA
+	notAfter := now.Add(m.options.Validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	servingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dnsNames := m.dnsNames()
+	servingTemplate := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	servingDER, err := x509.CreateCertificate(rand.Reader, servingTemplate, caCert, &servingKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	servingKeyDER, err := x509.MarshalECPrivateKey(servingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		CACertKey:               caPEM,
+		CAKeyKey:                caKeyPEM,
+		CABundleKey:             caBundle(caPEM, previous[CABundleKey], now),
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: servingDER}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: servingKeyDER}),
+	}, nil
+}
+
+// generateCA creates a self-signed CA valid for CAValidity
+func (m *Manager) generateCA(now time.Time) ([]byte, []byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-ca", m.options.ServiceName)},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(m.options.CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER}), nil
+}
+
+// caBundle puts the current CA first, followed by the CAs of the previous bundle that are still valid
+func caBundle(caPEM []byte, previous []byte, now time.Time) []byte {
+	bundle := append([]byte{}, caPEM...)
+	for {
+		var block *pem.Block
+		block, previous = pem.Decode(previous)
+		if block == nil {
+			return bundle
+		}
+		encoded := pem.EncodeToMemory(block)
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || now.After(certificate.NotAfter) || bytes.Equal(encoded, caPEM) {
+			continue
+		}
+		bundle = append(bundle, encoded...)
+	}
+}
+
+// patchCABundle sets the caBundle of every webhook in a ValidatingWebhookConfiguration. A
+// configuration that does not exist yet has no webhooks to call, so it is skipped until the
+// next reconcile.
+func (m *Manager) patchCABundle(ctx context.Context, name string, caBundle []byte) error {
+	webhookConfigurations := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configuration, err := webhookConfigurations.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			log.Warnf("ValidatingWebhookConfiguration %s does not exist, its caBundle will be set once it does", name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for i := range configuration.Webhooks {
+			if !bytes.Equal(configuration.Webhooks[i].ClientConfig.CABundle, caBundle) {
+				configuration.Webhooks[i].ClientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		_, err = webhookConfigurations.Update(ctx, configuration, metav1.UpdateOptions{})
+		if err == nil {
+			log.Infof("updated caBundle of ValidatingWebhookConfiguration %s", name)
+		}
+		return err
+	})
+}
+
+// parseCA parses the CA certificate and key of the Secret data
+func parseCA(data map[string][]byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certificate, err := parseCertificate(data[CACertKey])
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data[CAKeyKey])
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, nil, fmt.Errorf("no PEM EC private key found")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certificate, key, nil
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		// crypto/rand only fails when the operating system has no entropy source
+		panic(err)
+	}
+	return serial
+}
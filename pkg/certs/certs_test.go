@@ -0,0 +1,183 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testOptions = Options{
+	SecretNamespace:       "statcan-system",
+	SecretName:            "profile-state-controller-webhook-certs",
+	ServiceNamespace:      "statcan-system",
+	ServiceName:           "profile-state-controller",
+	WebhookConfigurations: []string{"profile-state-controller"},
+	Validity:              365 * 24 * time.Hour,
+	CAValidity:            5 * 365 * 24 * time.Hour,
+	RotateBefore:          30 * 24 * time.Hour,
+	CheckInterval:         time.Hour,
+}
+
+func newWebhookConfiguration() *admissionregistrationv1.ValidatingWebhookConfiguration {
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "profile-state-controller"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{Name: "state-labels.state.aaw.statcan.gc.ca"},
+			{Name: "sas-pods.state.aaw.statcan.gc.ca"},
+		},
+	}
+}
+
+func getSecret(t *testing.T, m *Manager) *corev1.Secret {
+	secret, err := m.client.CoreV1().Secrets(testOptions.SecretNamespace).Get(context.Background(), testOptions.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the certificate secret to exist: %v", err)
+	}
+	return secret
+}
+
+// The first reconcile creates the Secret, serves a certificate signed by the CA for the
+// Service's DNS names and publishes the CA to every webhook
+func TestReconcileBootstrapsCertificates(t *testing.T) {
+	m := NewManager(fake.NewSimpleClientset(newWebhookConfiguration()), testOptions)
+	if err := m.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	secret := getSecret(t, m)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[CABundleKey]) {
+		t.Fatalf("Expected the secret to contain a CA bundle")
+	}
+	served, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("Expected a certificate to be served: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(served.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse the served certificate: %v", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "profile-state-controller.statcan-system.svc"}); err != nil {
+		t.Fatalf("Expected the served certificate to verify against the CA bundle: %v", err)
+	}
+
+	configuration, _ := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), "profile-state-controller", metav1.GetOptions{})
+	for _, webhook := range configuration.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, secret.Data[CABundleKey]) {
+			t.Fatalf("Expected webhook %s to have the CA bundle from the secret", webhook.Name)
+		}
+	}
+}
+
+// A second replica reuses the certificates created by the first one
+func TestReconcileReusesExistingSecret(t *testing.T) {
+	client := fake.NewSimpleClientset(newWebhookConfiguration())
+	first := NewManager(client, testOptions)
+	if err := first.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	before := getSecret(t, first)
+
+	second := NewManager(client, testOptions)
+	if err := second.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	after := getSecret(t, second)
+
+	if !bytes.Equal(before.Data[corev1.TLSCertKey], after.Data[corev1.TLSCertKey]) {
+		t.Fatalf("Expected the second replica to reuse the existing certificate")
+	}
+}
+
+// Certificates that expire within RotateBefore are replaced, and the old CA stays trusted
+func TestReconcileRotatesBeforeExpiry(t *testing.T) {
+	client := fake.NewSimpleClientset(newWebhookConfiguration())
+	shortLived := testOptions
+	shortLived.Validity = 10 * 24 * time.Hour
+	if err := NewManager(client, shortLived).Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	m := NewManager(client, testOptions)
+	before := getSecret(t, m)
+	if err := m.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	after := getSecret(t, m)
+
+	if bytes.Equal(before.Data[corev1.TLSCertKey], after.Data[corev1.TLSCertKey]) {
+		t.Fatalf("Expected a certificate expiring within RotateBefore to be rotated")
+	}
+	if !bytes.Equal(before.Data[CACertKey], after.Data[CACertKey]) || !bytes.Equal(before.Data[CABundleKey], after.Data[CABundleKey]) {
+		t.Fatalf("Expected the CA and the bundle to be kept when only the serving certificate expires")
+	}
+}
+
+// A CA that expires within RotateBefore is replaced, and the new bundle trusts both CAs
+func TestReconcileRotatesCA(t *testing.T) {
+	client := fake.NewSimpleClientset(newWebhookConfiguration())
+	shortLived := testOptions
+	shortLived.CAValidity = 10 * 24 * time.Hour
+	if err := NewManager(client, shortLived).Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	m := NewManager(client, testOptions)
+	before := getSecret(t, m)
+	if err := m.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	after := getSecret(t, m)
+
+	if bytes.Equal(before.Data[CACertKey], after.Data[CACertKey]) {
+		t.Fatalf("Expected a CA expiring within RotateBefore to be rotated")
+	}
+	if !bytes.HasPrefix(after.Data[CABundleKey], after.Data[CACertKey]) || !bytes.Contains(after.Data[CABundleKey], before.Data[CACertKey]) {
+		t.Fatalf("Expected the bundle to hold the new CA followed by the previous one")
+	}
+}
+
+// The new certificate is only served once its CA is published, so a failure to update the
+// webhook configuration keeps the previous certificate
+func TestReconcileServesNewCertificateAfterPublishingCA(t *testing.T) {
+	client := fake.NewSimpleClientset(newWebhookConfiguration())
+	shortLived := testOptions
+	shortLived.CAValidity = 10 * 24 * time.Hour
+	m := NewManager(client, shortLived)
+	if err := m.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	served, _ := m.GetCertificate(nil)
+
+	client.PrependReactor("update", "validatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("update failed")
+	})
+	m.options = testOptions
+	if err := m.Reconcile(context.Background()); err == nil {
+		t.Fatalf("Expected Reconcile to fail when the CA cannot be published")
+	}
+	if current, _ := m.GetCertificate(nil); current != served {
+		t.Fatalf("Expected the previous certificate to be served until the new CA is published")
+	}
+}
+
+// A webhook configuration that does not exist yet does not prevent serving
+func TestReconcileSkipsMissingWebhookConfiguration(t *testing.T) {
+	m := NewManager(fake.NewSimpleClientset(), testOptions)
+	if err := m.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if _, err := m.GetCertificate(nil); err != nil {
+		t.Fatalf("Expected a certificate to be served: %v", err)
+	}
+}
@@ -0,0 +1,299 @@
+package controller
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// openAPIDocument describes the HTTP API
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// ProfileState is the controller's view of a Profile, as served by the HTTP API
+type ProfileState struct {
+	Evaluation
+	Profile string `json:"profile"`
+	// LiveLabels are the state labels currently set on the Profile
+	LiveLabels map[string]string `json:"liveLabels"`
+	// InSync is true when the live labels match the computed ones
+	InSync bool `json:"inSync"`
+}
+
+// Authorizer decides which namespaces the caller of an HTTP request may read
+type Authorizer interface {
+	// Authenticate wraps a handler so that it only receives requests from known callers
+	Authenticate(next http.Handler) http.Handler
+
+	// Authorized returns whether the caller may read a namespace, or every namespace when
+	// the namespace is empty
+	Authorized(r *http.Request, namespace string) (bool, error)
+
+	// Caller returns the username and groups of the caller of an authenticated request
+	Caller(r *http.Request) (username string, groups []string, ok bool)
+}
+
+// APIHandler returns the handler of the HTTP API, which answers from the informer caches and never writes.
+// When authorizer is nil, every caller may read every namespace.
+func (c *Controller) APIHandler(authorizer Authorizer) http.Handler {
+	api := &apiHandler{controller: c, authorizer: authorizer}
+
+	protected := http.NewServeMux()
+	protected.HandleFunc("/report", api.serveReport)
+	protected.HandleFunc("/profiles", api.serveProfiles)
+	protected.HandleFunc("/profiles/", api.serveProfileState)
+	protected.HandleFunc("/whatif", api.serveWhatIf)
+	protected.HandleFunc("/decision", api.serveDecision)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	})
+	if authorizer != nil {
+		mux.Handle("/", authorizer.Authenticate(protected))
+	} else {
+		mux.Handle("/", protected)
+	}
+	return mux
+}
+
+// apiHandler serves the API of a controller, checking access with an optional Authorizer
+type apiHandler struct {
+	controller *Controller
+	authorizer Authorizer
+}
+
+// authorized returns whether the caller may read a namespace ("" for all of them), writing
+// an error response when it may not
+func (api *apiHandler) authorized(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	allowed, err := api.allowed(r, namespace)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to authorize request: %v", err))
+		return false
+	}
+	if !allowed {
+		writeAPIError(w, http.StatusForbidden, "you are not allowed to read the state of this namespace")
+		return false
+	}
+	return true
+}
+
+func (api *apiHandler) allowed(r *http.Request, namespace string) (bool, error) {
+	if api.authorizer == nil {
+		return true, nil
+	}
+	return api.authorizer.Authorized(r, namespace)
+}
+
+// serveReport serves the report to callers who may read every namespace
+func (api *apiHandler) serveReport(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(w, r, "") {
+		return
+	}
+	api.controller.ServeReport(w, r)
+}
+
+// profileState computes the state of a Profile from the caches
+func (c *Controller) profileState(name string) (*ProfileState, error) {
+	profile, err := c.profileInformerLister.Lister().Get(name)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := c.namespaceObjects(name)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluation := evaluate(name, objects, c.policyConfig())
+	live := map[string]string{}
+	for _, label := range stateLabels {
+		if value, ok := profile.Labels[label]; ok {
+			live[label] = value
+		}
+	}
+	return &ProfileState{
+		Evaluation: evaluation,
+		Profile:    name,
+		LiveLabels: live,
+		InSync:     len(stateTransitions(live, evaluation.Labels)) == 0,
+	}, nil
+}
+
+// serveProfileState answers GET /profiles/{name}/state
+func (api *apiHandler) serveProfileState(w http.ResponseWriter, r *http.Request) {
+	c := api.controller
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/profiles/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "state" {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no such path %s", r.URL.Path))
+		return
+	}
+	if !c.checkAPIRequest(w, r, http.MethodGet) || !api.authorized(w, r, parts[0]) {
+		return
+	}
+
+	state, err := c.profileState(parts[0])
+	if errors.IsNotFound(err) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("profile %s not found", parts[0]))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAPIResponse(w, state)
+}
+
+// boundNamespaces returns the namespaces with a RoleBinding naming the caller, directly, through
+// one of their groups or as a ServiceAccount. Access to a single namespace can only be granted by
+// a RoleBinding, so these are the only namespaces that a caller without cluster-wide access may read.
+func (api *apiHandler) boundNamespaces(r *http.Request) (map[string]bool, error) {
+	namespaces := map[string]bool{}
+	username, groups, ok := api.authorizer.Caller(r)
+	if !ok {
+		return namespaces, nil
+	}
+	inGroups := map[string]bool{}
+	for _, group := range groups {
+		inGroups[group] = true
+	}
+
+	roleBindings, err := api.controller.roleBindingLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, roleBinding := range roleBindings {
+		for _, subject := range roleBinding.Subjects {
+			bound := false
+			switch subject.Kind {
+			case "User":
+				bound = subject.Name == username
+			case "Group":
+				bound = inGroups[subject.Name]
+			case "ServiceAccount":
+				namespace := subject.Namespace
+				if namespace == "" {
+					namespace = roleBinding.Namespace
+				}
+				bound = username == fmt.Sprintf("system:serviceaccount:%s:%s", namespace, subject.Name)
+			}
+			if bound {
+				namespaces[roleBinding.Namespace] = true
+				break
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// serveProfiles answers GET /profiles, keeping the Profiles whose computed labels match every
+// label query parameter. Each parameter is a Kubernetes label selector, for example
+// state.aaw.statcan.gc.ca/non-employee-users=true. Callers who may not read every namespace
+// only get the Profiles of the namespaces they may read, which are only checked when one of
+// the caller's RoleBindings is in them.
+func (api *apiHandler) serveProfiles(w http.ResponseWriter, r *http.Request) {
+	c := api.controller
+	if !c.checkAPIRequest(w, r, http.MethodGet) {
+		return
+	}
+	allNamespaces, err := api.allowed(r, "")
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to authorize request: %v", err))
+		return
+	}
+
+	var candidates map[string]bool
+	if !allNamespaces {
+		if candidates, err = api.boundNamespaces(r); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	selectors := []labels.Selector{}
+	for _, query := range r.URL.Query()["label"] {
+		selector, err := labels.Parse(query)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid label selector %q: %v", query, err))
+			return
+		}
+		selectors = append(selectors, selector)
+	}
+
+	profiles, err := c.profileInformerLister.Lister().List(labels.Everything())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	states := []*ProfileState{}
+	for _, profile := range profiles {
+		if !allNamespaces {
+			if !candidates[profile.Name] {
+				continue
+			}
+			allowed, err := api.allowed(r, profile.Name)
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to authorize request: %v", err))
+				return
+			}
+			if !allowed {
+				continue
+			}
+		}
+
+		state, err := c.profileState(profile.Name)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		matches := true
+		for _, selector := range selectors {
+			if !selector.Matches(labels.Set(state.Labels)) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			states = append(states, state)
+		}
+	}
+	writeAPIResponse(w, states)
+}
+
+// checkAPIRequest rejects requests with another method, or that the API cannot answer yet
+func (c *Controller) checkAPIRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+		return false
+	}
+	if !c.hasSynced() {
+		writeAPIError(w, http.StatusServiceUnavailable, "informer caches are not synced yet")
+		return false
+	}
+	return true
+}
+
+func writeAPIResponse(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("failed to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
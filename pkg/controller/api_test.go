@@ -0,0 +1,203 @@
+/*
+These tests query the HTTP API of mock controllers whose informers list and watch fake clientsets.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func getAPI(t *testing.T, c *Controller, path string, body interface{}) int {
+	recorder := httptest.NewRecorder()
+	c.APIHandler(nil).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code == http.StatusOK && body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("Failed to decode the response of %s: %v", path, err)
+		}
+	}
+	return recorder.Code
+}
+
+// alice runs a SAS pod but her Profile still has the label set to false
+func TestGetProfileState(t *testing.T) {
+	c := newMockListerController(t, &v1.Profile{ObjectMeta: metav1.ObjectMeta{
+		Name:   "alice",
+		Labels: map[string]string{HAS_SAS_NOTEBOOK_FEATURE_LABEL: "false"},
+	}})
+
+	state := ProfileState{}
+	if code := getAPI(t, c, "/profiles/alice/state", &state); code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", code)
+	}
+	if state.Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] != "true" || len(state.Reasons[HAS_SAS_NOTEBOOK_FEATURE_LABEL]) == 0 {
+		t.Fatalf("Expected has-sas-notebook-feature=true with a reason, got %+v", state)
+	}
+	if state.LiveLabels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] != "false" || state.InSync {
+		t.Fatalf("Expected the live label to differ from the computed one, got %+v", state)
+	}
+}
+
+func TestGetUnknownProfileState(t *testing.T) {
+	if code := getAPI(t, newMockReportController(t), "/profiles/nobody/state", nil); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 but got %d", code)
+	}
+}
+
+func TestListProfilesByLabel(t *testing.T) {
+	states := []ProfileState{}
+	if code := getAPI(t, newMockReportController(t), "/profiles?label="+NON_EMPLOYEE_USER+"%3Dtrue", &states); code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", code)
+	}
+	names := []string{}
+	for _, state := range states {
+		names = append(names, state.Profile)
+	}
+	// sam has test@external.ca and jane has jane.doe@notanemployee.ca
+	if len(names) != 2 || names[0] != "jane" || names[1] != "sam" {
+		t.Fatalf("Expected profiles jane and sam but got %v", names)
+	}
+}
+
+func TestListProfilesRejectsInvalidSelector(t *testing.T) {
+	if code := getAPI(t, newMockReportController(t), "/profiles?label=%3D%3D%3D", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 but got %d", code)
+	}
+}
+
+// The OpenAPI document is valid JSON and documents every path served by APIHandler
+func TestOpenAPIDocumentsEveryPath(t *testing.T) {
+	document := struct {
+		Paths map[string]interface{} `json:"paths"`
+	}{}
+	if code := getAPI(t, newMockReportController(t), "/openapi.json", &document); code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d", code)
+	}
+	for _, path := range []string{"/profiles", "/profiles/{name}/state", "/report", "/whatif", "/decision"} {
+		if _, ok := document.Paths[path]; !ok {
+			t.Errorf("Expected the OpenAPI document to describe %s", path)
+		}
+	}
+}
+
+// mockAuthorizer lets the caller named in the X-User header read the namespaces listed for them.
+// The user admin may read every namespace. Every access check is counted in checks when it is set.
+type mockAuthorizer struct {
+	namespaces map[string][]string
+	checks     *int
+}
+
+func (m mockAuthorizer) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-User") == "" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m mockAuthorizer) Caller(r *http.Request) (string, []string, bool) {
+	user := r.Header.Get("X-User")
+	return user, nil, user != ""
+}
+
+func (m mockAuthorizer) Authorized(r *http.Request, namespace string) (bool, error) {
+	if m.checks != nil {
+		*m.checks++
+	}
+	user := r.Header.Get("X-User")
+	if user == "admin" {
+		return true, nil
+	}
+	for _, allowed := range m.namespaces[user] {
+		if allowed == namespace {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var mockAPIAuthorizer = mockAuthorizer{namespaces: map[string][]string{"sam@statcan.gc.ca": {"sam"}}}
+
+func getAPIAs(t *testing.T, user string, path string, body interface{}) int {
+	return getAPIWith(t, mockAPIAuthorizer, user, path, body)
+}
+
+func getAPIWith(t *testing.T, authorizer Authorizer, user string, path string, body interface{}) int {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	if user != "" {
+		request.Header.Set("X-User", user)
+	}
+	recorder := httptest.NewRecorder()
+	newMockReportController(t).APIHandler(authorizer).ServeHTTP(recorder, request)
+	if recorder.Code == http.StatusOK && body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("Failed to decode the response of %s: %v", path, err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestAPIRequiresAuthentication(t *testing.T) {
+	if code := getAPIAs(t, "", "/profiles/sam/state", nil); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 but got %d", code)
+	}
+	if code := getAPIAs(t, "", "/openapi.json", nil); code != http.StatusOK {
+		t.Fatalf("Expected the OpenAPI document to be public but got %d", code)
+	}
+}
+
+// Namespace members see only their own namespace, and only admins get the report
+func TestAPIAuthorizesNamespaceMembers(t *testing.T) {
+	if code := getAPIAs(t, "sam@statcan.gc.ca", "/profiles/sam/state", nil); code != http.StatusOK {
+		t.Fatalf("Expected sam to read namespace sam but got %d", code)
+	}
+	if code := getAPIAs(t, "sam@statcan.gc.ca", "/profiles/bob/state", nil); code != http.StatusForbidden {
+		t.Fatalf("Expected sam not to read namespace bob but got %d", code)
+	}
+	if code := getAPIAs(t, "sam@statcan.gc.ca", "/report", nil); code != http.StatusForbidden {
+		t.Fatalf("Expected sam not to read the report but got %d", code)
+	}
+	if code := getAPIAs(t, "admin", "/report", nil); code != http.StatusOK {
+		t.Fatalf("Expected admin to read the report but got %d", code)
+	}
+
+	states := []ProfileState{}
+	getAPIAs(t, "sam@statcan.gc.ca", "/profiles", &states)
+	if len(states) != 1 || states[0].Profile != "sam" {
+		t.Fatalf("Expected sam to list only profile sam but got %+v", states)
+	}
+	getAPIAs(t, "admin", "/profiles", &states)
+	if len(states) != 5 {
+		t.Fatalf("Expected admin to list the 5 profiles but got %d", len(states))
+	}
+}
+
+// Listing Profiles checks access to every namespace once, then only to the namespaces with
+// a RoleBinding naming the caller
+func TestListProfilesChecksOnlyBoundNamespaces(t *testing.T) {
+	checks := 0
+	authorizer := mockAuthorizer{namespaces: mockAPIAuthorizer.namespaces, checks: &checks}
+
+	states := []ProfileState{}
+	getAPIWith(t, authorizer, "sam@statcan.gc.ca", "/profiles", &states)
+	if len(states) != 1 || states[0].Profile != "sam" {
+		t.Fatalf("Expected sam to list only profile sam but got %+v", states)
+	}
+	if checks != 2 {
+		t.Fatalf("Expected a cluster-wide check and a check of namespace sam but got %d checks", checks)
+	}
+
+	checks = 0
+	getAPIWith(t, authorizer, "nobody@statcan.gc.ca", "/profiles", &states)
+	if len(states) != 0 || checks != 1 {
+		t.Fatalf("Expected a caller without RoleBindings to list nothing after one check but got %d profiles and %d checks", len(states), checks)
+	}
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/audit"
+)
+
+// auditInputs summarises the objects of a namespace for the audit log
+func auditInputs(objects NamespaceObjects) *audit.Inputs {
+	inputs := &audit.Inputs{
+		Pods:                   len(objects.Pods),
+		RoleBindings:           len(objects.RoleBindings),
+		PersistentVolumeClaims: len(objects.PersistentVolumeClaims),
+		Users:                  []string{},
+	}
+	seen := map[string]bool{}
+	for _, roleBinding := range objects.RoleBindings {
+		for _, subject := range roleBinding.Subjects {
+			if subject.Kind == "User" && !seen[subject.Name] {
+				seen[subject.Name] = true
+				inputs.Users = append(inputs.Users, subject.Name)
+			}
+		}
+	}
+	sort.Strings(inputs.Users)
+	return inputs
+}
+
+// writeAuditRecord appends the record of a sync to the audit log, when enabled
+func (c *Controller) writeAuditRecord(record *audit.Record, err error) {
+	if c.options.AuditLog == nil {
+		return
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := c.options.AuditLog.Write(*record); err != nil {
+		log.Errorf("failed to write the audit record of profile %v: %v", record.Profile, err)
+	}
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	"github.com/statcan/profile-state-controller/pkg/audit"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Each sync appends one record to the audit log, including dry-run syncs and deleted profiles
+func TestSyncWritesAuditRecord(t *testing.T) {
+	c := newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+	)
+	c.options.DryRun = true
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.Open(audit.Options{Path: path})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	c.options.AuditLog = sink
+
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+	if err := c.syncHandler("nobody"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+	sink.Close()
+
+	records := []*audit.Record{}
+	if err := readAuditRecords(path, &records); err != nil {
+		t.Fatalf("Failed to read the audit log: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records but got %d", len(records))
+	}
+
+	alice := records[0]
+	if alice.Profile != "alice" || !alice.DryRun || alice.Deleted || alice.Inputs == nil || alice.Inputs.Pods == 0 {
+		t.Errorf("Expected a dry-run record of alice with its inputs but got %+v", alice)
+	}
+	if alice.State[HAS_SAS_NOTEBOOK_FEATURE_LABEL] != "true" {
+		t.Errorf("Expected the state of alice to have the SAS notebook feature but got %v", alice.State)
+	}
+	if len(alice.Written) != 0 {
+		t.Errorf("Expected no writes in dry-run mode but got %+v", alice.Written)
+	}
+	if nobody := records[1]; nobody.Profile != "nobody" || !nobody.Deleted || nobody.Inputs != nil {
+		t.Errorf("Expected a record of the deleted profile but got %+v", nobody)
+	}
+
+	if count, err := audit.Verify([]string{path}, audit.VerifyOptions{}); err != nil || count != 2 {
+		t.Errorf("Expected the audit log to verify but got %d: %v", count, err)
+	}
+}
+
+func readAuditRecords(path string, records *[]*audit.Record) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		record := &audit.Record{}
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			return err
+		}
+		*records = append(*records, record)
+	}
+	return nil
+}
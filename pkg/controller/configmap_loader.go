@@ -8,17 +8,36 @@ import (
 )
 
 func UnmarshalConf(configmapPath string) map[string][]string {
-	yfile, err := ioutil.ReadFile(configmapPath)
+	conf, err := LoadConf(configmapPath)
 	if err != nil {
 		log.Println(err)
 	}
 
+	return conf
+}
+
+// LoadConf reads the exceptions configuration and reports whether it could be loaded.
+// The returned map is never nil, so callers can fall back to an empty configuration.
+func LoadConf(configmapPath string) (map[string][]string, error) {
 	conf := make(map[string][]string)
 
-	err2 := yaml.Unmarshal(yfile, &conf)
-	if err2 != nil {
-		log.Println(err2)
+	yfile, err := ioutil.ReadFile(configmapPath)
+	if err != nil {
+		return conf, err
 	}
 
-	return conf
+	return ParseConf(yfile)
+}
+
+// ParseConf parses the exceptions configuration, for example from the data of a ConfigMap.
+// Like LoadConf, it never returns a nil map.
+func ParseConf(data []byte) (map[string][]string, error) {
+	conf := make(map[string][]string)
+
+	err := yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return conf, err
+	}
+
+	return conf, nil
 }
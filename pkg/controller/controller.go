@@ -2,16 +2,22 @@ package controller
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
 	kubeflow "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned"
+	kubeflowscheme "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned/scheme"
 	informers "github.com/StatCan/kubeflow-controller/pkg/generated/informers/externalversions/kubeflowcontroller/v1"
 
 	//v1 "github.com/StatCan/kubeflow-apis/apis/kubeflow/v1"
 	//kubeflow "github.com/StatCan/kubeflow-apis/clientset/versioned"
 	//informers "github.com/StatCan/kubeflow-apis/informers/externalversions/kubeflow/v1"
 	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/audit"
+	"github.com/statcan/profile-state-controller/pkg/history"
+	"github.com/statcan/profile-state-controller/pkg/policy"
 	corev1 "k8s.io/api/core/v1"
 	k8sinformers "k8s.io/client-go/informers/core/v1"
 	k8slisters "k8s.io/client-go/listers/core/v1"
@@ -20,7 +26,7 @@ import (
 	rbacv1listers "k8s.io/client-go/listers/rbac/v1"
 
 	rbacv1 "k8s.io/api/rbac/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/api/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
@@ -59,7 +65,63 @@ type Controller struct {
 	workqueue workqueue.RateLimitingInterface
 	recorder  record.EventRecorder
 
+	// triggers holds the object that last caused each profile key to be enqueued
+	triggersMutex sync.Mutex
+	triggers      map[string]string
+
+	// lastState holds the labels last computed for each profile, to detect hand edits, and
+	// pendingState the labels being written, whose update events are not hand edits
+	lastStateMutex sync.Mutex
+	lastState      map[string]map[string]string
+	pendingState   map[string]map[string]string
+
 	nonEmployeeExceptions map[string][]string
+	exceptionsErr         error
+
+	// history keeps the state transitions of each Profile, when enabled
+	history *history.Store
+
+	// health tracking, accessed atomically
+	workersRunning int32
+	lastSyncTime   int64
+	queuedSince    int64
+
+	options Options
+}
+
+// Options holds the optional behaviour of the Controller
+type Options struct {
+	// CleanupOrphanedNamespaces removes the managed labels from a Namespace whose Profile
+	// has been deleted
+	CleanupOrphanedNamespaces bool
+
+	// RecordNamespaceEvents also records state transition Events against the Namespace,
+	// in addition to the Profile
+	RecordNamespaceEvents bool
+
+	// WorkerStuckTimeout is how long the workers may go without finishing a sync while
+	// the queue is non-empty before the liveness check fails
+	WorkerStuckTimeout time.Duration
+
+	// LeaderElection indicates that workers only run on the elected replica, so a
+	// standby replica is ready as soon as its caches are synced
+	LeaderElection bool
+
+	// DryRun computes the labels and reports the differences through logs and metrics,
+	// without writing labels or recording Events
+	DryRun bool
+
+	// HistoryNamespace keeps the state transitions of each Profile in a ConfigMap of this
+	// namespace. History is not kept when empty.
+	HistoryNamespace string
+
+	// HistoryLimit and HistoryRetention bound the number and the age of the entries kept
+	// per Profile
+	HistoryLimit     int
+	HistoryRetention time.Duration
+
+	// AuditLog receives one record per sync, when set
+	AuditLog *audit.Sink
 }
 
 // NewController creates a new Controller object.
@@ -70,7 +132,11 @@ func NewController(
 	namespaceInformer k8sinformers.NamespaceInformer,
 	podInformer k8sinformers.PodInformer,
 	roleBindingInformer rbacv1informers.RoleBindingInformer,
-	persistentVolumeClaimInformer k8sinformers.PersistentVolumeClaimInformer) *Controller {
+	persistentVolumeClaimInformer k8sinformers.PersistentVolumeClaimInformer,
+	options Options) *Controller {
+
+	// Register the Profile types so that Events can reference them
+	utilruntime.Must(kubeflowscheme.AddToScheme(scheme.Scheme))
 
 	// Create event broadcaster
 	log.Info("creating event broadcaster")
@@ -79,6 +145,11 @@ func NewController(
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
+	exceptions, exceptionsErr := LoadConf("./app/non-employee-exceptions.yaml")
+	if exceptionsErr != nil {
+		log.Errorf("failed to load non-employee exceptions: %v", exceptionsErr)
+	}
+
 	controller := &Controller{
 		kubeclientset:                 kubeclientset,
 		kubeflowClientset:             kubeflowclientset,
@@ -97,21 +168,55 @@ func NewController(
 		persistentVolumeClaimSynced:   persistentVolumeClaimInformer.Informer().HasSynced,
 		workqueue:                     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "PodPolicy"),
 		recorder:                      recorder,
-		nonEmployeeExceptions:         UnmarshalConf("./app/non-employee-exceptions.yaml"),
+		triggers:                      make(map[string]string),
+		lastState:                     make(map[string]map[string]string),
+		pendingState:                  make(map[string]map[string]string),
+		nonEmployeeExceptions:         exceptions,
+		exceptionsErr:                 exceptionsErr,
+		options:                       options,
+	}
+
+	if options.HistoryNamespace != "" {
+		controller.history = history.NewStore(kubeclientset, history.Options{
+			Namespace: options.HistoryNamespace,
+			Limit:     options.HistoryLimit,
+			Retention: options.HistoryRetention,
+		})
 	}
 
 	// Set up an event handler for when Profile resources change
 	profileInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: controller.enqueueProfile,
+		AddFunc: controller.handleProfileObject,
 		UpdateFunc: func(old, new interface{}) {
 			np := new.(*v1.Profile)
 			op := old.(*v1.Profile)
 			if np.ResourceVersion == op.ResourceVersion {
 				return
 			}
-			controller.enqueueProfile(new)
+			if drifted := controller.driftedLabels(np.Name, np.Labels); len(drifted) > 0 {
+				log.Infof("detected drift of labels %v on profile %v", drifted, np.Name)
+				controller.setTrigger(np.Name, fmt.Sprintf("Profile %s label edit", np.Name))
+				controller.enqueueProfile(np)
+				return
+			}
+			controller.handleProfileObject(new)
+		},
+		DeleteFunc: controller.handleProfileObject,
+	})
+
+	// Set up an event handler for when Namespace resources are created, as a Profile's
+	// namespace is usually created after the Profile itself, and for when their labels
+	// are edited by hand
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.handleNamespaceObject,
+		UpdateFunc: func(old, new interface{}) {
+			newns := new.(*corev1.Namespace)
+			oldns := old.(*corev1.Namespace)
+			if newns.ResourceVersion == oldns.ResourceVersion {
+				return
+			}
+			controller.handleNamespaceUpdate(newns)
 		},
-		DeleteFunc: controller.enqueueProfile,
 	})
 
 	// Set up an event handler for when Pod resources change
@@ -153,42 +258,91 @@ func NewController(
 			}
 			controller.handlePVCObject(newPVC)
 		},
-		DeleteFunc: controller.handleRoleBindingObject,
+		DeleteFunc: controller.handlePVCObject,
 	})
 
 	return controller
 }
 
+// unwrapTombstone returns the last known state of a deleted object. Delete notifications
+// carry a cache.DeletedFinalStateUnknown instead of the object when the watch missed the deletion.
+func unwrapTombstone(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+func (c *Controller) handleProfileObject(newProfile interface{}) {
+	profile, ok := unwrapTombstone(newProfile).(*v1.Profile)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected Profile but got %#v", newProfile))
+		return
+	}
+	c.setTrigger(profile.Name, fmt.Sprintf("Profile %s", profile.Name))
+	c.enqueueProfile(profile)
+}
+
+func (c *Controller) handleNamespaceObject(newNamespace interface{}) {
+	namespace, ok := unwrapTombstone(newNamespace).(*corev1.Namespace)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected Namespace but got %#v", newNamespace))
+		return
+	}
+	existingProfile, err := c.profileInformerLister.Lister().Get(namespace.Name)
+	if err != nil {
+		// Most namespaces do not belong to a profile
+		return
+	}
+	c.setTrigger(existingProfile.Name, fmt.Sprintf("Namespace %s", namespace.Name))
+	c.enqueueProfile(existingProfile)
+}
+
 func (c *Controller) handlePodObject(npod interface{}) {
-	pod := npod.(*corev1.Pod)
+	pod, ok := unwrapTombstone(npod).(*corev1.Pod)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected Pod but got %#v", npod))
+		return
+	}
 	namespace := pod.GetNamespace()
 	existingProfile, err := c.profileInformerLister.Lister().Get(namespace)
 	if err != nil {
 		log.Errorf("failed to get profile: %v", err)
 		return
 	}
+	c.setTrigger(existingProfile.Name, fmt.Sprintf("Pod %s/%s", namespace, pod.Name))
 	c.enqueueProfile(existingProfile)
 }
 
 func (c *Controller) handleRoleBindingObject(newrb interface{}) {
-	roleBinding := newrb.(*rbacv1.RoleBinding)
+	roleBinding, ok := unwrapTombstone(newrb).(*rbacv1.RoleBinding)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected RoleBinding but got %#v", newrb))
+		return
+	}
 	namespace := roleBinding.GetNamespace()
 	existingProfile, err := c.profileInformerLister.Lister().Get(namespace)
 	if err != nil {
 		log.Errorf("failed to get profile - rb: %v", err)
 		return
 	}
+	c.setTrigger(existingProfile.Name, fmt.Sprintf("RoleBinding %s/%s", namespace, roleBinding.Name))
 	c.enqueueProfile(existingProfile)
 }
 
 func (c *Controller) handlePVCObject(newPVC interface{}) {
-	pvc := newPVC.(*corev1.PersistentVolumeClaim)
+	pvc, ok := unwrapTombstone(newPVC).(*corev1.PersistentVolumeClaim)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected PersistentVolumeClaim but got %#v", newPVC))
+		return
+	}
 	namespace := pvc.GetNamespace()
 	existingProfile, err := c.profileInformerLister.Lister().Get(namespace)
 	if err != nil {
 		log.Errorf("failed to get profile - pvc: %v", err)
 		return
 	}
+	c.setTrigger(existingProfile.Name, fmt.Sprintf("PersistentVolumeClaim %s/%s", namespace, pvc.Name))
 	c.enqueueProfile(existingProfile)
 }
 
@@ -197,18 +351,31 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
 
-	if ok := cache.WaitForCacheSync(stopCh, c.podSynched, c.profileSynched); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.cachesSynced()...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
 	log.Info("starting workers")
+	var workers sync.WaitGroup
 	for i := 0; i < threadiness; i++ {
-		go wait.Until(c.runWorker, time.Second, stopCh)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(c.runWorker, time.Second, stopCh)
+		}()
 	}
+	c.markSyncFinished()
+	atomic.StoreInt32(&c.workersRunning, 1)
+	defer atomic.StoreInt32(&c.workersRunning, 0)
 
 	log.Info("started workers")
 	<-stopCh
 	log.Info("shutting down workers")
+	// Wait for the syncs in progress, so that their audit records are written before the
+	// caller closes the audit log
+	c.workqueue.ShutDown()
+	workers.Wait()
+	log.Info("stopped workers")
 
 	return nil
 }
@@ -224,9 +391,13 @@ func (c *Controller) processNextWorkItem() bool {
 	if shutdown {
 		return false
 	}
+	if c.workqueue.Len() == 0 {
+		c.markQueueDrained()
+	}
 
 	err := func(obj interface{}) error {
 		defer c.workqueue.Done(obj)
+		defer c.markSyncFinished()
 		var key string
 		var ok bool
 
@@ -254,47 +425,59 @@ func (c *Controller) processNextWorkItem() bool {
 	return true
 }
 
-func (c *Controller) syncHandler(key string) error {
+func (c *Controller) syncHandler(key string) (err error) {
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		syncDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
+
+	trigger := c.popTrigger(key)
+	record := &audit.Record{Profile: key, Trigger: trigger, DryRun: c.options.DryRun, Written: []audit.Write{}}
+	defer func() {
+		c.writeAuditRecord(record, err)
+	}()
+
 	// Get the profile and namespace associated with the current key.
 	profile, err := c.profileInformerLister.Lister().Get(key)
+	if errors.IsNotFound(err) {
+		// The profile was deleted, so there is nothing left to label
+		log.Infof("profile %v no longer exists", key)
+		c.forgetLastState(key)
+		record.Deleted = true
+		return c.handleDeletedProfile(key, record)
+	}
 	if err != nil {
-		log.Errorf("failed to get profile %v with error: %v", profile, err)
+		log.Errorf("failed to get profile %v with error: %v", key, err)
 		return err
 	}
 	namespace, err := c.namespaceInformerLister.Lister().Get(key)
+	if errors.IsNotFound(err) {
+		// The namespace informer will enqueue the profile again once the namespace is created
+		log.Infof("namespace %v does not exist yet", key)
+		return nil
+	}
 	if err != nil {
-		log.Errorf("failed to get namespace %v with error: %v", namespace, err)
+		log.Errorf("failed to get namespace %v with error: %v", key, err)
 		return err
 	}
-	// Get the pods and rolebindings in the current namespace
+	// Get the pods, rolebindings and pvcs in the current namespace
 	// Note: profile.Name is used below instead of namespace as it is a string instead of
 	// type corev1.Namespace.
-	pods, err := c.podLister.Pods(profile.Name).List(labels.Everything())
-	if err != nil {
-		return err
-	}
-	roleBindings, err := c.roleBindingLister.RoleBindings(profile.Name).List(labels.Everything())
-	if err != nil {
-		return err
-	}
-	pvcs, err := c.persistentVolumeClaimlister.PersistentVolumeClaims(profile.Name).List(labels.Everything())
+	objects, err := c.namespaceObjects(profile.Name)
 	if err != nil {
 		return err
 	}
 	// for extensibility, use slice to store all bools to limit params on "handleProfileAndNamespace"
-	feats := make([]bool, 5)
-
-	// Handle SAS labels for namespace
-	feats[0] = c.hasSasNotebookFeature(pods)
-	feats[1] = c.existsNonSasUser(roleBindings)
-	// Handle cloud main labels for namespace
-	feats[2] = c.existsNonCloudMainUser(roleBindings)
-	// Handle Non Employees
-	feats[3] = c.existsNonEmployee(roleBindings)
-	// Handle fdi internal storage
-	feats[4] = c.existsInternalCommonStorage(pvcs)
-
-	err = c.handleProfileAndNamespace(profile, namespace, feats)
+	state, reasons := policy.Evaluate(objects, c.policyConfig())
+	feats := state.Values()
+	record.Inputs = auditInputs(objects)
+	record.State = state.Labels()
+
+	err = c.handleProfileAndNamespace(profile, namespace, feats, reasons, trigger, record)
 	if err != nil {
 		log.Errorf("failed to handle profile or namespace: %v", err)
 		return err
@@ -306,9 +489,31 @@ func (c *Controller) syncHandler(key string) error {
 func (c *Controller) enqueueProfile(obj interface{}) {
 	var key string
 	var err error
-	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+	if key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
+	c.markQueued()
 	c.workqueue.Add(key)
 }
+
+// setTrigger remembers the object that caused a profile to be enqueued, so that
+// Events recorded during the next sync can name it.
+func (c *Controller) setTrigger(key string, trigger string) {
+	c.triggersMutex.Lock()
+	defer c.triggersMutex.Unlock()
+	c.triggers[key] = trigger
+}
+
+// popTrigger returns and forgets the trigger for a profile key. Periodic resyncs
+// have no recorded trigger.
+func (c *Controller) popTrigger(key string) string {
+	c.triggersMutex.Lock()
+	defer c.triggersMutex.Unlock()
+	trigger, ok := c.triggers[key]
+	if !ok {
+		return "resync"
+	}
+	delete(c.triggers, key)
+	return trigger
+}
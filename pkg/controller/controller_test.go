@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	kubeflowfake "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned/fake"
+	kubeflowinformers "github.com/StatCan/kubeflow-controller/pkg/generated/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// Build a controller through NewController whose informers list and watch fake clientsets holding
+// the RoleBindings from the tests/4 (namespace sam, with a non-employee) and tests/5 (namespace bob,
+// employees only) folders, the SAS pod in namespace alice, the internal PVC in namespace test, plus
+// any given objects. It uses the test exceptions and records Events in a FakeRecorder.
+func newMockListerController(t *testing.T, objects ...runtime.Object) *Controller {
+	for _, folder := range []string{"4", "5"} {
+		rolebindings, _ := getRolebindings(filepath.Join(TEST_DIRECTORY, folder))
+		for _, rolebinding := range rolebindings {
+			objects = append(objects, rolebinding)
+		}
+	}
+	sasPod, _ := getPod(filepath.Join(TEST_DIRECTORY, "1/2_pod_has_sas_image.yaml"))
+	internalPVC, _ := getPVC(filepath.Join(TEST_DIRECTORY, "blob/1/iunc_pvc_exists.yaml"))
+	objects = append(objects, sasPod, internalPVC)
+
+	kubeObjects := []runtime.Object{}
+	kubeflowObjects := []runtime.Object{}
+	for _, object := range objects {
+		if _, ok := object.(*v1.Profile); ok {
+			kubeflowObjects = append(kubeflowObjects, object)
+		} else {
+			kubeObjects = append(kubeObjects, object)
+		}
+	}
+	kubeclientset := fake.NewSimpleClientset(kubeObjects...)
+	kubeflowClientset := kubeflowfake.NewSimpleClientset(kubeflowObjects...)
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeclientset, 0)
+	kubeflowInformerFactory := kubeflowinformers.NewSharedInformerFactory(kubeflowClientset, 0)
+
+	c := NewController(kubeclientset, kubeflowClientset,
+		kubeflowInformerFactory.Kubeflow().V1().Profiles(),
+		kubeInformerFactory.Core().V1().Namespaces(),
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Rbac().V1().RoleBindings(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		Options{})
+	c.nonEmployeeExceptions, c.exceptionsErr = mockController.nonEmployeeExceptions, nil
+	c.recorder = record.NewFakeRecorder(1000)
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+		c.workqueue.ShutDown()
+	})
+	kubeInformerFactory.Start(stopCh)
+	kubeflowInformerFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.cachesSynced()...) {
+		t.Fatalf("Failed to sync the informers with the fake clientsets")
+	}
+	return c
+}
+
+// writeActions drops the reads, such as the lists and watches of the informers, from the actions
+// of a fake clientset
+func writeActions(actions []k8stesting.Action) []k8stesting.Action {
+	writes := []k8stesting.Action{}
+	for _, action := range actions {
+		switch action.GetVerb() {
+		case "get", "list", "watch":
+		default:
+			writes = append(writes, action)
+		}
+	}
+	return writes
+}
+
+// Run returns only once the syncs in progress are done, so that main closes the audit log after
+// the workers wrote their records
+func TestRunWaitsForSyncsInProgress(t *testing.T) {
+	c := newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}})
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	c.kubeflowClientset.(*kubeflowfake.Clientset).PrependReactor("patch", "profiles", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		once.Do(func() { close(syncing) })
+		<-release
+		return false, nil, nil
+	})
+	c.handleProfileObject(&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}})
+
+	stopCh := make(chan struct{})
+	returned := make(chan error)
+	go func() {
+		returned <- c.Run(1, stopCh)
+	}()
+
+	select {
+	case <-syncing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the profile was not synced")
+	}
+	close(stopCh)
+	select {
+	case <-returned:
+		t.Fatal("Expected Run to wait for the sync in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("Run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return once the sync finished")
+	}
+}
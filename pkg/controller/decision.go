@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Features that other components ask decisions about
+const (
+	FEATURE_SAS_NOTEBOOK     = "sas-notebook"
+	FEATURE_CLOUD_MAIN       = "cloud-main"
+	FEATURE_INTERNAL_STORAGE = "internal-storage"
+)
+
+// featurePolicy is what a subject and a namespace must satisfy for a feature to be used
+type featurePolicy struct {
+	// exceptionList lets non-employees use the feature, when set
+	exceptionList string
+	// deniedSubject returns whether the subject itself may not use the feature
+	deniedSubject func(config policy.Config, subject rbacv1.Subject) bool
+	// namespaceLabel is true when the namespace has users who may not share the feature
+	namespaceLabel string
+}
+
+var featurePolicies = map[string]featurePolicy{
+	FEATURE_SAS_NOTEBOOK: {
+		exceptionList:  policy.SAS_NOTEBOOK_EXCEPTIONS,
+		deniedSubject:  policy.Config.NonSasUser,
+		namespaceLabel: EXISTS_NON_SAS_NOTEBOOK_USER_LABEL,
+	},
+	FEATURE_CLOUD_MAIN: {
+		exceptionList:  policy.CLOUD_MAIN_EXCEPTIONS,
+		deniedSubject:  policy.Config.NonCloudMainUser,
+		namespaceLabel: EXISTS_NON_CLOUD_MAIN_USER_LABEL,
+	},
+	FEATURE_INTERNAL_STORAGE: {
+		deniedSubject: func(_ policy.Config, subject rbacv1.Subject) bool {
+			return policy.NonEmployee(subject)
+		},
+		namespaceLabel: NON_EMPLOYEE_USER,
+	},
+}
+
+// Features lists the features that Decide knows about
+func Features() []string {
+	features := []string{}
+	for feature := range featurePolicies {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Decision answers whether a subject may use a feature in a namespace
+type Decision struct {
+	Subject   rbacv1.Subject `json:"subject"`
+	Feature   string         `json:"feature"`
+	Namespace string         `json:"namespace"`
+	Allowed   bool           `json:"allowed"`
+	// Reasons explain the decision, and list every check that failed when it is a denial
+	Reasons []string `json:"reasons"`
+}
+
+// Decide applies the policy of the state labels to one subject: the subject must be an employee
+// or in the exceptions list of the feature, and the namespace's current state, computed from the
+// caches, must not have users who may not share the feature.
+func (c *Controller) Decide(subject rbacv1.Subject, feature string, namespace string) (*Decision, error) {
+	rule, ok := featurePolicies[feature]
+	if !ok {
+		return nil, fmt.Errorf("unknown feature %q, expected one of %s", feature, strings.Join(Features(), ", "))
+	}
+	if subject.Name == "" {
+		return nil, fmt.Errorf("subject is required")
+	}
+	if subject.Kind == "" {
+		subject.Kind = "User"
+	}
+	if _, err := c.profileInformerLister.Lister().Get(namespace); err != nil {
+		return nil, err
+	}
+	objects, err := c.namespaceObjects(namespace)
+	if err != nil {
+		return nil, err
+	}
+	config := c.policyConfig()
+	computed, _ := policy.Evaluate(objects, config)
+	state := computed.Labels()
+
+	decision := &Decision{Subject: subject, Feature: feature, Namespace: namespace, Allowed: true, Reasons: []string{}}
+	if rule.deniedSubject(config, subject) {
+		decision.Allowed = false
+		reason := fmt.Sprintf("%s is not an employee (%s)", subject.Name, policy.NonEmployeeReason(subject.Name))
+		if rule.exceptionList != "" {
+			reason += " and is not in " + rule.exceptionList
+		}
+		decision.Reasons = append(decision.Reasons, reason)
+	}
+	if state[rule.namespaceLabel] == "true" {
+		decision.Allowed = false
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf("namespace %s has %s=true", namespace, rule.namespaceLabel))
+	}
+
+	if decision.Allowed {
+		switch {
+		case subject.Kind != "User":
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("only User subjects are checked, %s is a %s", subject.Name, subject.Kind))
+		case rule.exceptionList != "" && !policy.InternalUser(subject.Name):
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("%s is in %s", subject.Name, rule.exceptionList))
+		default:
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("%s is an employee", subject.Name))
+		}
+		decision.Reasons = append(decision.Reasons, fmt.Sprintf("namespace %s has %s=false", namespace, rule.namespaceLabel))
+	}
+	return decision, nil
+}
+
+// serveDecision answers GET /decision?namespace=&feature=&subject=[&kind=]
+func (api *apiHandler) serveDecision(w http.ResponseWriter, r *http.Request) {
+	c := api.controller
+	if !c.checkAPIRequest(w, r, http.MethodGet) {
+		return
+	}
+
+	query := r.URL.Query()
+	namespace := query.Get("namespace")
+	if namespace == "" {
+		writeAPIError(w, http.StatusBadRequest, "namespace is required")
+		return
+	}
+	if !api.authorized(w, r, namespace) {
+		return
+	}
+
+	subject := rbacv1.Subject{Kind: query.Get("kind"), Name: query.Get("subject")}
+	decision, err := c.Decide(subject, query.Get("feature"), namespace)
+	if errors.IsNotFound(err) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("profile %s not found", namespace))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIResponse(w, decision)
+}
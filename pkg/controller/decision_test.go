@@ -0,0 +1,101 @@
+/*
+These tests ask the mock report controller for decisions about subjects and features in its namespaces.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestDecide(t *testing.T) {
+	c := newMockReportController(t)
+	for _, test := range []struct {
+		subject   string
+		feature   string
+		namespace string
+		allowed   bool
+		reason    string
+	}{
+		// Employees may use every feature in a namespace of employees
+		{"bob@statcan.gc.ca", FEATURE_SAS_NOTEBOOK, "bob", true, "bob@statcan.gc.ca is an employee"},
+		{"bob@statcan.gc.ca", FEATURE_INTERNAL_STORAGE, "bob", true, "bob@statcan.gc.ca is an employee"},
+		// The exceptions lists let non-employees use SAS and cloud main, but not internal storage
+		{"jane.doe@notanemployee.ca", FEATURE_SAS_NOTEBOOK, "bob", true, "is in sasNotebookExceptions"},
+		{"jane.doe@notanemployee.ca", FEATURE_CLOUD_MAIN, "bob", true, "is in cloudMainExceptions"},
+		{"jane.doe@notanemployee.ca", FEATURE_INTERNAL_STORAGE, "bob", false, "is not an employee"},
+		{"someone@external.ca", FEATURE_SAS_NOTEBOOK, "bob", false, "is not in sasNotebookExceptions"},
+		// Employees may not use a feature that the namespace's other users may not share
+		{"sam@statcan.gc.ca", FEATURE_SAS_NOTEBOOK, "sam", false, EXISTS_NON_SAS_NOTEBOOK_USER_LABEL + "=true"},
+		{"jane@statcan.gc.ca", FEATURE_SAS_NOTEBOOK, "jane", true, EXISTS_NON_SAS_NOTEBOOK_USER_LABEL + "=false"},
+		{"jane@statcan.gc.ca", FEATURE_INTERNAL_STORAGE, "jane", false, NON_EMPLOYEE_USER + "=true"},
+	} {
+		decision, err := c.Decide(rbacv1.Subject{Name: test.subject}, test.feature, test.namespace)
+		if err != nil {
+			t.Fatalf("Decide failed: %v", err)
+		}
+		if decision.Allowed != test.allowed || !strings.Contains(strings.Join(decision.Reasons, "\n"), test.reason) {
+			t.Errorf("Expected allowed=%t because %q for %s using %s in %s but got %+v",
+				test.allowed, test.reason, test.subject, test.feature, test.namespace, decision)
+		}
+	}
+}
+
+// Both failed checks are reported when a non-employee asks for SAS in a namespace with a non-SAS user
+func TestDecideListsEveryReason(t *testing.T) {
+	decision, err := newMockReportController(t).Decide(rbacv1.Subject{Name: "someone@external.ca"}, FEATURE_SAS_NOTEBOOK, "sam")
+	if err != nil {
+		t.Fatalf("Decide failed: %v", err)
+	}
+	if decision.Allowed || len(decision.Reasons) != 2 {
+		t.Fatalf("Expected a denial with 2 reasons but got %+v", decision)
+	}
+}
+
+func TestDecideErrors(t *testing.T) {
+	c := newMockReportController(t)
+	if _, err := c.Decide(rbacv1.Subject{Name: "bob@statcan.gc.ca"}, "gpu", "bob"); err == nil {
+		t.Errorf("Expected an error for an unknown feature")
+	}
+	if _, err := c.Decide(rbacv1.Subject{Name: "bob@statcan.gc.ca"}, FEATURE_SAS_NOTEBOOK, "nobody"); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound for a namespace without a Profile but got %v", err)
+	}
+}
+
+func TestServeDecision(t *testing.T) {
+	for _, test := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{http.MethodGet, "?namespace=sam&feature=sas-notebook&subject=sam@statcan.gc.ca", http.StatusOK},
+		{http.MethodPost, "?namespace=sam&feature=sas-notebook&subject=sam@statcan.gc.ca", http.StatusMethodNotAllowed},
+		{http.MethodGet, "?feature=sas-notebook&subject=sam@statcan.gc.ca", http.StatusBadRequest},
+		{http.MethodGet, "?namespace=sam&feature=sas-notebook", http.StatusBadRequest},
+		{http.MethodGet, "?namespace=sam&feature=gpu&subject=sam@statcan.gc.ca", http.StatusBadRequest},
+		{http.MethodGet, "?namespace=nobody&feature=sas-notebook&subject=sam@statcan.gc.ca", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		newMockReportController(t).APIHandler(nil).ServeHTTP(recorder, httptest.NewRequest(test.method, "/decision"+test.query, nil))
+		if recorder.Code != test.code {
+			t.Errorf("Expected %d for %s %s but got %d", test.code, test.method, test.query, recorder.Code)
+			continue
+		}
+		if recorder.Code == http.StatusOK {
+			decision := Decision{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &decision); err != nil {
+				t.Fatalf("Failed to decode the response: %v", err)
+			}
+			if decision.Allowed || decision.Subject.Kind != "User" {
+				t.Errorf("Expected sam@statcan.gc.ca to be denied SAS in sam but got %+v", decision)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+These tests check how deletions are handled: tombstones left by missed watch events, and
+profiles that no longer exist, with and without the cleanup of orphaned namespaces.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestUnwrapTombstone(t *testing.T) {
+	profile := &v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}
+
+	if obj := unwrapTombstone(profile); obj != profile {
+		t.Errorf("Expected the object itself but got %#v", obj)
+	}
+	tombstone := cache.DeletedFinalStateUnknown{Key: "alice", Obj: profile}
+	if obj := unwrapTombstone(tombstone); obj != profile {
+		t.Errorf("Expected the last known state of the profile but got %#v", obj)
+	}
+}
+
+// A Profile whose deletion was missed by the watch is still enqueued
+func TestHandleProfileTombstone(t *testing.T) {
+	c := newMockListerController(t)
+
+	c.handleProfileObject(cache.DeletedFinalStateUnknown{
+		Key: "alice",
+		Obj: &v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+	})
+
+	if c.workqueue.Len() != 1 {
+		t.Fatalf("Expected the profile to be enqueued but the queue holds %d items", c.workqueue.Len())
+	}
+	key, _ := c.workqueue.Get()
+	if key != "alice" {
+		t.Errorf("Expected key alice but got %v", key)
+	}
+}
+
+// The state of a profile that no longer exists is forgotten, so that its namespace is not
+// reported as drifted
+func TestSyncForgetsDeletedProfile(t *testing.T) {
+	c := newMockListerController(t)
+	c.setLastState("carol", desiredLabels([]bool{true, false, false, false, false}))
+
+	if err := c.syncHandler("carol"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+	if _, ok := c.getLastState("carol"); ok {
+		t.Errorf("Expected the state of the deleted profile to be forgotten")
+	}
+}
+
+func TestOrphanedNamespaceCleanup(t *testing.T) {
+	labels := desiredLabels([]bool{true, false, false, true, false})
+	labels["owner"] = "carol"
+
+	tests := []struct {
+		name     string
+		cleanup  bool
+		deleting bool
+		expected map[string]string
+	}{
+		{name: "cleanup disabled", cleanup: false, expected: labels},
+		{name: "cleanup enabled", cleanup: true, expected: map[string]string{"owner": "carol"}},
+		{name: "namespace being deleted", cleanup: true, deleting: true, expected: labels},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "carol", Labels: labels}}
+			if test.deleting {
+				now := metav1.Now()
+				namespace.DeletionTimestamp = &now
+			}
+			c := newMockListerController(t, namespace)
+			c.options.CleanupOrphanedNamespaces = test.cleanup
+			kubeclientset := c.kubeclientset.(*fake.Clientset)
+
+			if err := c.syncHandler("carol"); err != nil {
+				t.Fatalf("syncHandler failed: %v", err)
+			}
+
+			actions := writeActions(kubeclientset.Actions())
+			if test.cleanup && !test.deleting && len(actions) != 1 {
+				t.Errorf("Expected a single patch but got %v", actions)
+			}
+			if (!test.cleanup || test.deleting) && len(actions) != 0 {
+				t.Errorf("Expected no writes but got %v", actions)
+			}
+			updated, err := kubeclientset.CoreV1().Namespaces().Get(context.Background(), "carol", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Failed to get the namespace: %v", err)
+			}
+			if !reflect.DeepEqual(updated.Labels, test.expected) {
+				t.Errorf("Expected labels %v but got %v", test.expected, updated.Labels)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+// Event reason recorded when hand-edited labels are put back
+const STATE_LABEL_DRIFT_CORRECTED_REASON = "StateLabelDriftCorrected"
+
+// setLastState remembers the labels last computed for a profile, once they have been written
+func (c *Controller) setLastState(key string, labels map[string]string) {
+	c.lastStateMutex.Lock()
+	defer c.lastStateMutex.Unlock()
+	c.lastState[key] = labels
+	delete(c.pendingState, key)
+}
+
+// setPendingState remembers the labels about to be written for a profile, so that the update
+// events caused by the controller's own patches are not taken for hand edits. They are kept
+// after a failed write, as a patch may have been applied before the failure.
+func (c *Controller) setPendingState(key string, labels map[string]string) {
+	c.lastStateMutex.Lock()
+	defer c.lastStateMutex.Unlock()
+	c.pendingState[key] = labels
+}
+
+// getLastState returns the labels last computed for a profile, if it has been synced
+func (c *Controller) getLastState(key string) (map[string]string, bool) {
+	c.lastStateMutex.Lock()
+	defer c.lastStateMutex.Unlock()
+	labels, ok := c.lastState[key]
+	return labels, ok
+}
+
+func (c *Controller) forgetLastState(key string) {
+	c.lastStateMutex.Lock()
+	defer c.lastStateMutex.Unlock()
+	delete(c.lastState, key)
+	delete(c.pendingState, key)
+}
+
+// driftedLabels lists the managed labels of an object that match neither the state last
+// computed for its profile nor the state being written. Nothing is reported for profiles
+// that were never synced.
+func (c *Controller) driftedLabels(key string, current map[string]string) []string {
+	c.lastStateMutex.Lock()
+	last, ok := c.lastState[key]
+	pending, writing := c.pendingState[key]
+	c.lastStateMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	drifted := []string{}
+	for _, transition := range stateTransitions(current, last) {
+		if writing && current[transition.label] == pending[transition.label] {
+			continue
+		}
+		drifted = append(drifted, transition.label)
+	}
+	return drifted
+}
+
+// handleNamespaceUpdate re-enqueues a profile as soon as someone edits the managed labels
+// of its namespace, rather than waiting for the next unrelated event.
+func (c *Controller) handleNamespaceUpdate(newNamespace interface{}) {
+	namespace, ok := newNamespace.(*corev1.Namespace)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected Namespace but got %#v", newNamespace))
+		return
+	}
+	drifted := c.driftedLabels(namespace.Name, namespace.Labels)
+	if len(drifted) == 0 {
+		return
+	}
+	log.Infof("detected drift of labels %v on namespace %v", drifted, namespace.Name)
+	c.setTrigger(namespace.Name, fmt.Sprintf("Namespace %s label edit", namespace.Name))
+	c.markQueued()
+	c.workqueue.Add(namespace.Name)
+}
+
+// recordDriftCorrection logs and records an Event for labels that were put back after
+// being edited by hand
+func (c *Controller) recordDriftCorrection(object runtime.Object, kind string, name string, transitions []stateTransition) {
+	changes := []string{}
+	for _, transition := range transitions {
+		oldValue := transition.oldValue
+		if oldValue == "" {
+			oldValue = "<unset>"
+		}
+		changes = append(changes, fmt.Sprintf("%s from %s to %s", transition.label, oldValue, transition.newValue))
+	}
+	message := fmt.Sprintf("Restored hand-edited labels on %s %s: %s", kind, name, strings.Join(changes, ", "))
+	log.Info(message)
+	c.recorder.Event(object, corev1.EventTypeWarning, STATE_LABEL_DRIFT_CORRECTED_REASON, message)
+}
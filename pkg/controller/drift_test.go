@@ -0,0 +1,126 @@
+/*
+These tests check that hand edits of the managed labels are detected and corrected, and that the
+updates caused by the controller's own writes are not taken for hand edits.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestDriftedLabels(t *testing.T) {
+	c := newMockListerController(t)
+	last := desiredLabels([]bool{true, false, false, false, false})
+
+	if drifted := c.driftedLabels("alice", map[string]string{}); drifted != nil {
+		t.Errorf("Expected no drift before the first sync but got %v", drifted)
+	}
+
+	c.setLastState("alice", last)
+	if drifted := c.driftedLabels("alice", last); len(drifted) != 0 {
+		t.Errorf("Expected no drift when the labels match but got %v", drifted)
+	}
+	edited := desiredLabels([]bool{false, false, false, false, false})
+	edited["owner"] = "alice"
+	if drifted := c.driftedLabels("alice", edited); !reflect.DeepEqual(drifted, []string{HAS_SAS_NOTEBOOK_FEATURE_LABEL}) {
+		t.Errorf("Expected the SAS notebook feature to have drifted but got %v", drifted)
+	}
+
+	// Labels being written are not drift, but labels matching neither state are
+	c.setPendingState("alice", edited)
+	if drifted := c.driftedLabels("alice", edited); len(drifted) != 0 {
+		t.Errorf("Expected no drift for the labels being written but got %v", drifted)
+	}
+	other := desiredLabels([]bool{false, false, false, true, false})
+	if drifted := c.driftedLabels("alice", other); !reflect.DeepEqual(drifted, []string{NON_EMPLOYEE_USER}) {
+		t.Errorf("Expected the non-employee label to have drifted but got %v", drifted)
+	}
+
+	// Once written, the pending labels become the last state
+	c.setLastState("alice", edited)
+	if drifted := c.driftedLabels("alice", last); !reflect.DeepEqual(drifted, []string{HAS_SAS_NOTEBOOK_FEATURE_LABEL}) {
+		t.Errorf("Expected the SAS notebook feature to have drifted but got %v", drifted)
+	}
+}
+
+func TestHandleNamespaceUpdate(t *testing.T) {
+	c := newMockListerController(t)
+	last := desiredLabels([]bool{true, false, false, false, false})
+	c.setLastState("alice", last)
+
+	c.handleNamespaceUpdate(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: last}})
+	if c.workqueue.Len() != 0 {
+		t.Fatalf("Expected a namespace with the computed labels not to be enqueued")
+	}
+
+	edited := desiredLabels([]bool{false, false, false, false, false})
+	c.handleNamespaceUpdate(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: edited}})
+	if c.workqueue.Len() != 1 {
+		t.Fatalf("Expected the edited namespace to be enqueued but the queue holds %d items", c.workqueue.Len())
+	}
+	if trigger := c.popTrigger("alice"); trigger != "Namespace alice label edit" {
+		t.Errorf("Expected the label edit as trigger but got %q", trigger)
+	}
+}
+
+func TestRecordDriftCorrection(t *testing.T) {
+	c := newMockListerController(t)
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}
+
+	c.recordDriftCorrection(namespace, "namespace", "alice", []stateTransition{
+		{label: HAS_SAS_NOTEBOOK_FEATURE_LABEL, oldValue: "", newValue: "true"},
+		{label: NON_EMPLOYEE_USER, oldValue: "true", newValue: "false"},
+	})
+
+	expected := fmt.Sprintf("Warning %s Restored hand-edited labels on namespace alice: %s from <unset> to true, %s from true to false",
+		STATE_LABEL_DRIFT_CORRECTED_REASON, HAS_SAS_NOTEBOOK_FEATURE_LABEL, NON_EMPLOYEE_USER)
+	if events := recordedEvents(c); !reflect.DeepEqual(events, []string{expected}) {
+		t.Errorf("Expected %q but got %v", expected, events)
+	}
+}
+
+// The update of the profile caused by the controller's own patch arrives while the namespace is
+// still being written, or after that write failed. It must not be reported as drift.
+func TestOwnWritesAreNotDrift(t *testing.T) {
+	c, kubeclientset := newMockSyncController(t)
+	profileDrift := []string{}
+	kubeclientset.PrependReactor("patch", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		profile, err := c.kubeflowClientset.KubeflowV1().Profiles().Get(context.Background(), "alice", metav1.GetOptions{})
+		if err != nil {
+			return true, nil, err
+		}
+		profileDrift = c.driftedLabels("alice", profile.Labels)
+		return true, nil, fmt.Errorf("namespace patch failed")
+	})
+
+	if err := c.syncHandler("alice"); err == nil {
+		t.Fatalf("Expected the sync to fail")
+	}
+	if len(profileDrift) != 0 {
+		t.Errorf("Expected the patched profile not to be drift while the namespace was written but got %v", profileDrift)
+	}
+
+	profile, err := c.kubeflowClientset.KubeflowV1().Profiles().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched profile: %v", err)
+	}
+	if drifted := c.driftedLabels("alice", profile.Labels); len(drifted) != 0 {
+		t.Errorf("Expected the patched profile not to be drift after the failed namespace patch but got %v", drifted)
+	}
+
+	// A hand edit made after the failed write is still detected
+	edited := profile.DeepCopy()
+	edited.Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] = "false"
+	if drifted := c.driftedLabels("alice", edited.Labels); !reflect.DeepEqual(drifted, []string{HAS_SAS_NOTEBOOK_FEATURE_LABEL}) {
+		t.Errorf("Expected the SAS notebook feature to have drifted but got %v", drifted)
+	}
+}
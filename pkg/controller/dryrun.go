@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// dryRunDiffs counts the label changes a dry-run controller would have written
+var dryRunDiffs = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "dry_run_diffs_total",
+	Help:      "Number of label changes computed but not written in dry-run mode, by resource and label.",
+}, []string{"resource", "label"})
+
+// describeTransitions formats label changes as label: old -> new
+func describeTransitions(transitions []stateTransition) string {
+	changes := []string{}
+	for _, transition := range transitions {
+		oldValue := transition.oldValue
+		if oldValue == "" {
+			oldValue = "<unset>"
+		}
+		newValue := transition.newValue
+		if newValue == "" {
+			newValue = "<unset>"
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", transition.label, oldValue, newValue))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// reportDryRun logs and counts the changes that would have been written to an object
+func reportDryRun(resource string, name string, transitions []stateTransition, trigger string) {
+	if len(transitions) == 0 {
+		return
+	}
+	for _, transition := range transitions {
+		dryRunDiffs.WithLabelValues(resource, transition.label).Inc()
+	}
+	log.Infof("[dry-run] would update %s %s (triggered by %s): %s", resource, name, trigger, describeTransitions(transitions))
+}
@@ -0,0 +1,43 @@
+/*
+These tests run syncHandler in dry-run mode and check that nothing is written to the API.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	kubeflowfake "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// The SAS pod in namespace alice would set has-sas-notebook-feature, but dry-run only reports it
+func TestDryRunSyncDoesNotWrite(t *testing.T) {
+	c := newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+	)
+	c.options.DryRun = true
+
+	before := testutil.ToFloat64(dryRunDiffs.WithLabelValues("namespace", HAS_SAS_NOTEBOOK_FEATURE_LABEL))
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+
+	if actions := writeActions(c.kubeclientset.(*fake.Clientset).Actions()); len(actions) > 0 {
+		t.Fatalf("Expected no Kubernetes API writes in dry-run mode, got %v", actions)
+	}
+	if actions := writeActions(c.kubeflowClientset.(*kubeflowfake.Clientset).Actions()); len(actions) > 0 {
+		t.Fatalf("Expected no Kubeflow API writes in dry-run mode, got %v", actions)
+	}
+	if _, ok := c.getLastState("alice"); ok {
+		t.Fatalf("Expected dry-run mode not to remember a state that was never written")
+	}
+	if after := testutil.ToFloat64(dryRunDiffs.WithLabelValues("namespace", HAS_SAS_NOTEBOOK_FEATURE_LABEL)); after != before+1 {
+		t.Fatalf("Expected the namespace diff to be counted once, got %v", after-before)
+	}
+}
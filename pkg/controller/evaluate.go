@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// NamespaceObjects holds the objects of one namespace that the detectors look at
+type NamespaceObjects = policy.Inputs
+
+// Evaluation is the state computed for a namespace, with the reasons behind each label
+type Evaluation struct {
+	Namespace string              `json:"namespace"`
+	Labels    map[string]string   `json:"labels"`
+	Reasons   map[string][]string `json:"reasons"`
+}
+
+// Evaluate runs the same detectors as syncHandler on objects that do not come from a cluster,
+// for example manifests read from disk.
+func Evaluate(namespace string, objects NamespaceObjects, exceptions map[string][]string) Evaluation {
+	return evaluate(namespace, objects, policy.Config{Exceptions: exceptions})
+}
+
+// evaluate computes the labels of a namespace and explains each of them
+func evaluate(namespace string, objects NamespaceObjects, config policy.Config) Evaluation {
+	state, reasons := policy.Evaluate(objects, config)
+	return Evaluation{
+		Namespace: namespace,
+		Labels:    state.Labels(),
+		Reasons:   reasons,
+	}
+}
+
+// namespaceObjects reads the objects of a namespace from the informer caches
+func (c *Controller) namespaceObjects(namespace string) (NamespaceObjects, error) {
+	objects := NamespaceObjects{}
+	var err error
+
+	if objects.Pods, err = c.podLister.Pods(namespace).List(labels.Everything()); err != nil {
+		return objects, err
+	}
+	if objects.RoleBindings, err = c.roleBindingLister.RoleBindings(namespace).List(labels.Everything()); err != nil {
+		return objects, err
+	}
+	if objects.PersistentVolumeClaims, err = c.persistentVolumeClaimlister.PersistentVolumeClaims(namespace).List(labels.Everything()); err != nil {
+		return objects, err
+	}
+	return objects, nil
+}
@@ -0,0 +1,101 @@
+/*
+These tests evaluate the k3d manifests in the cluster/ folder offline, as the evaluate command does.
+*/
+
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+const CLUSTER_DIRECTORY = "../../cluster/"
+
+func evaluateClusterManifests(t *testing.T) map[string]Evaluation {
+	manifests, err := LoadManifests(CLUSTER_DIRECTORY)
+	if err != nil {
+		t.Fatalf("Failed to load manifests: %v", err)
+	}
+	evaluations := map[string]Evaluation{}
+	for _, namespace := range manifests.Namespaces() {
+		evaluations[namespace] = Evaluate(namespace, manifests.ObjectsIn(namespace), mockController.nonEmployeeExceptions)
+	}
+	return evaluations
+}
+
+// The manifests hold the Profiles, Pods and RoleBindings of alice, bob and sam, and skip the k3d config
+func TestLoadManifestsFindsEveryNamespace(t *testing.T) {
+	manifests, err := LoadManifests(CLUSTER_DIRECTORY)
+	if err != nil {
+		t.Fatalf("Failed to load manifests: %v", err)
+	}
+	if len(manifests.Profiles) != 3 {
+		t.Fatalf("Expected 3 profiles but got %d", len(manifests.Profiles))
+	}
+	if namespaces := strings.Join(manifests.Namespaces(), ","); namespaces != "alice,bob,sam" {
+		t.Fatalf("Expected namespaces alice,bob,sam but got %s", namespaces)
+	}
+}
+
+// The expected labels are the ones described in cluster/README.md
+func TestEvaluateClusterManifests(t *testing.T) {
+	expected := map[string]map[string]string{
+		"alice": {HAS_SAS_NOTEBOOK_FEATURE_LABEL: "true", EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: "false", NON_EMPLOYEE_USER: "false"},
+		"bob":   {HAS_SAS_NOTEBOOK_FEATURE_LABEL: "false", EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: "true", NON_EMPLOYEE_USER: "true"},
+		"sam":   {HAS_SAS_NOTEBOOK_FEATURE_LABEL: "true", EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: "true", NON_EMPLOYEE_USER: "true"},
+	}
+
+	evaluations := evaluateClusterManifests(t)
+	for namespace, labels := range expected {
+		for label, value := range labels {
+			if got := evaluations[namespace].Labels[label]; got != value {
+				t.Errorf("Expected %s=%s in namespace %s but got %s", label, value, namespace, got)
+			}
+		}
+	}
+}
+
+// Every label comes with at least one reason, and a true non-employee label names the subject
+func TestEvaluateExplainsEveryLabel(t *testing.T) {
+	evaluation := evaluateClusterManifests(t)["bob"]
+	for _, label := range stateLabels {
+		if len(evaluation.Reasons[label]) == 0 {
+			t.Errorf("Expected a reason for %s", label)
+		}
+	}
+	if reason := evaluation.Reasons[NON_EMPLOYEE_USER][0]; !strings.Contains(reason, "bob@external.ca") {
+		t.Fatalf("Expected the non-employee reason to name bob@external.ca but got %q", reason)
+	}
+}
+
+// The items of a List are read, and objects of kinds the policy does not look at are reported
+func TestLoadManifestsUnwrapsLists(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	manifests, err := LoadManifests("../../tests/manifests/")
+	if err != nil {
+		t.Fatalf("Failed to load manifests: %v", err)
+	}
+	roleBindings := manifests.ObjectsIn("bob").RoleBindings
+	if len(roleBindings) != 1 || roleBindings[0].Name != "user-bob-external" {
+		t.Fatalf("Expected the RoleBinding user-bob-external in the List but got %v", roleBindings)
+	}
+	evaluation := Evaluate("bob", manifests.ObjectsIn("bob"), mockController.nonEmployeeExceptions)
+	if got := evaluation.Labels[NON_EMPLOYEE_USER]; got != "true" {
+		t.Errorf("Expected %s=true for the RoleBinding in the List but got %s", NON_EMPLOYEE_USER, got)
+	}
+
+	warned := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "skipping a ConfigMap") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("Expected a warning for the ConfigMap in the List")
+	}
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Event reasons recorded by the controller
+const (
+	STATE_LABEL_CHANGED_REASON = "StateLabelChanged"
+)
+
+// stateLabels lists the managed labels in the same order as the feats slice built in syncHandler
+var stateLabels = policy.StateLabels()
+
+// StateLabels returns the labels managed by the controller
+func StateLabels() []string {
+	return append([]string{}, stateLabels...)
+}
+
+// stateTransition describes a managed label whose value differs from the one last written
+type stateTransition struct {
+	label    string
+	oldValue string
+	newValue string
+}
+
+// desiredLabels maps the computed feats onto their managed label keys
+func desiredLabels(feats []bool) map[string]string {
+	labels := make(map[string]string, len(stateLabels))
+	for i, label := range stateLabels {
+		labels[label] = strconv.FormatBool(feats[i])
+	}
+	return labels
+}
+
+// managedLabels copies the managed labels that are set on an object
+func managedLabels(labels map[string]string) map[string]string {
+	managed := make(map[string]string, len(stateLabels))
+	for _, label := range stateLabels {
+		if value, ok := labels[label]; ok {
+			managed[label] = value
+		}
+	}
+	return managed
+}
+
+// stateTransitions compares the current labels of an object against the desired labels.
+// A label that is not set yet is reported with an empty old value.
+func stateTransitions(current map[string]string, desired map[string]string) []stateTransition {
+	transitions := []stateTransition{}
+	for _, label := range stateLabels {
+		if current[label] != desired[label] {
+			transitions = append(transitions, stateTransition{
+				label:    label,
+				oldValue: current[label],
+				newValue: desired[label],
+			})
+		}
+	}
+	return transitions
+}
+
+// riskyCombination is a pair of labels that downstream policies have to block when both are true
+type riskyCombination struct {
+	feature     string
+	users       string
+	description string
+}
+
+// riskyCombinations are external users next to a SAS notebook or next to internal FDI storage
+var riskyCombinations = []riskyCombination{
+	{HAS_SAS_NOTEBOOK_FEATURE_LABEL, EXISTS_NON_SAS_NOTEBOOK_USER_LABEL, "users who may not use SAS would share the namespace with a SAS notebook"},
+	{EXISTS_INTERNAL_BLOB_STORAGE, NON_EMPLOYEE_USER, "non-employees would share the namespace with internal FDI storage"},
+}
+
+func (r riskyCombination) matches(labels map[string]string) bool {
+	return labels[r.feature] == "true" && labels[r.users] == "true"
+}
+
+// riskyState returns true when the labels describe one of the riskyCombinations
+func riskyState(labels map[string]string) bool {
+	for _, combination := range riskyCombinations {
+		if combination.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTransitions emits one Event per changed label against the profile, and against the
+// namespace when enabled. Transitions into a risky combination are recorded as Warnings.
+func (c *Controller) recordTransitions(profile *v1.Profile, namespace *corev1.Namespace, transitions []stateTransition, desired map[string]string, trigger string) {
+	eventType := corev1.EventTypeNormal
+	if riskyState(desired) {
+		eventType = corev1.EventTypeWarning
+	}
+
+	for _, transition := range transitions {
+		oldValue := transition.oldValue
+		if oldValue == "" {
+			oldValue = "<unset>"
+		}
+		message := fmt.Sprintf("Label %s changed from %s to %s (triggered by %s)",
+			transition.label, oldValue, transition.newValue, trigger)
+
+		c.recorder.Event(profile, eventType, STATE_LABEL_CHANGED_REASON, message)
+		if c.options.RecordNamespaceEvents {
+			c.recorder.Event(namespace, eventType, STATE_LABEL_CHANGED_REASON, message)
+		}
+	}
+}
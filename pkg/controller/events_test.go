@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+// newMockSyncController is a mock controller whose clientsets also hold the profile and namespace
+// alice, so that syncHandler can write to them
+func newMockSyncController(t *testing.T) (*Controller, *fake.Clientset) {
+	c := newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}})
+	return c, c.kubeclientset.(*fake.Clientset)
+}
+
+func recordedEvents(c *Controller) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-c.recorder.(*record.FakeRecorder).Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// A namespace patch that fails after the profile was patched must not lose the transitions
+func TestTransitionsRecordedAfterFailedNamespacePatch(t *testing.T) {
+	c, kubeclientset := newMockSyncController(t)
+	failed := false
+	kubeclientset.PrependReactor("patch", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, fmt.Errorf("namespace patch failed")
+	})
+
+	if err := c.syncHandler("alice"); err == nil {
+		t.Fatalf("Expected the first sync to fail")
+	}
+	if events := recordedEvents(c); len(events) != 0 {
+		t.Fatalf("Expected no Events before both writes succeed but got %v", events)
+	}
+
+	// The informer has seen the patched profile by the time the sync is retried
+	profile, err := c.kubeflowClientset.KubeflowV1().Profiles().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched profile: %v", err)
+	}
+	c.profileInformerLister.Informer().GetIndexer().Update(profile)
+
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+	events := recordedEvents(c)
+	if len(events) != len(stateLabels) {
+		t.Fatalf("Expected one Event per state label but got %v", events)
+	}
+	if !strings.Contains(strings.Join(events, "\n"), "Label "+HAS_SAS_NOTEBOOK_FEATURE_LABEL+" changed from <unset> to true") {
+		t.Errorf("Expected the SAS notebook feature transition but got %v", events)
+	}
+
+	// Nothing changed since, so a resync records nothing
+	namespace, err := c.kubeclientset.CoreV1().Namespaces().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched namespace: %v", err)
+	}
+	c.namespaceInformerLister.Informer().GetIndexer().Update(namespace)
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+	if events := recordedEvents(c); len(events) != 0 {
+		t.Errorf("Expected no Events on resync but got %v", events)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	current := map[string]string{HAS_SAS_NOTEBOOK_FEATURE_LABEL: "false", NON_EMPLOYEE_USER: "false"}
+	desired := desiredLabels([]bool{true, false, false, false, false})
+
+	transitions := stateTransitions(current, desired)
+	if len(transitions) != 4 {
+		t.Fatalf("Expected the SAS notebook feature and the 3 unset labels to change but got %+v", transitions)
+	}
+	sas := transitions[0]
+	if sas.label != HAS_SAS_NOTEBOOK_FEATURE_LABEL || sas.oldValue != "false" || sas.newValue != "true" {
+		t.Errorf("Expected the SAS notebook feature to change from false to true but got %+v", sas)
+	}
+	for _, transition := range transitions[1:] {
+		if transition.oldValue != "" || transition.newValue != "false" {
+			t.Errorf("Expected %s to change from unset to false but got %+v", transition.label, transition)
+		}
+	}
+
+	if transitions := stateTransitions(desired, desired); len(transitions) != 0 {
+		t.Errorf("Expected no transitions when the labels match but got %+v", transitions)
+	}
+}
+
+// Transitions are recorded as Warnings when they lead to a risky combination, and against the
+// namespace only when enabled
+func TestRecordTransitions(t *testing.T) {
+	profile := &v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}
+
+	for _, test := range []struct {
+		name            string
+		feats           []bool
+		namespaceEvents bool
+		events          int
+		eventType       string
+	}{
+		{"safe", []bool{true, false, false, false, false}, false, 1, corev1.EventTypeNormal},
+		{"sas next to a non-sas user", []bool{true, true, false, false, false}, false, 1, corev1.EventTypeWarning},
+		{"internal storage next to a non-employee", []bool{false, false, false, true, true}, true, 2, corev1.EventTypeWarning},
+	} {
+		recorder := record.NewFakeRecorder(10)
+		c := &Controller{recorder: recorder, options: Options{RecordNamespaceEvents: test.namespaceEvents}}
+		desired := desiredLabels(test.feats)
+		transitions := []stateTransition{{label: NON_EMPLOYEE_USER, oldValue: "", newValue: desired[NON_EMPLOYEE_USER]}}
+		c.recordTransitions(profile, namespace, transitions, desired, "Pod alice/notebook-0")
+
+		if len(recorder.Events) != test.events {
+			t.Fatalf("%s: expected %d Events but got %d", test.name, test.events, len(recorder.Events))
+		}
+		event := <-recorder.Events
+		expected := test.eventType + " " + STATE_LABEL_CHANGED_REASON + " Label " + NON_EMPLOYEE_USER + " changed from <unset> to "
+		if !strings.HasPrefix(event, expected) || !strings.HasSuffix(event, "(triggered by Pod alice/notebook-0)") {
+			t.Errorf("%s: expected an Event like %q but got %q", test.name, expected, event)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EXCEPTIONS_CONFIGMAP_KEY is the key of the exceptions file in the non-employee-exceptions ConfigMap
+const EXCEPTIONS_CONFIGMAP_KEY = "non-employee-exceptions.yaml"
+
+// FetchNamespaceObjects lists the objects of a namespace that the detectors look at, straight
+// from the API server
+func FetchNamespaceObjects(ctx context.Context, client kubernetes.Interface, namespace string) (NamespaceObjects, error) {
+	objects := NamespaceObjects{}
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return objects, err
+	}
+	for i := range pods.Items {
+		objects.Pods = append(objects.Pods, &pods.Items[i])
+	}
+
+	roleBindings, err := client.RbacV1().RoleBindings(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return objects, err
+	}
+	for i := range roleBindings.Items {
+		objects.RoleBindings = append(objects.RoleBindings, &roleBindings.Items[i])
+	}
+
+	pvcs, err := client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return objects, err
+	}
+	for i := range pvcs.Items {
+		objects.PersistentVolumeClaims = append(objects.PersistentVolumeClaims, &pvcs.Items[i])
+	}
+
+	return objects, nil
+}
+
+// FetchExceptions reads the exceptions from the ConfigMap that is mounted into the controller
+func FetchExceptions(ctx context.Context, client kubernetes.Interface, namespace string, name string) (map[string][]string, error) {
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := configMap.Data[EXCEPTIONS_CONFIGMAP_KEY]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s/%s has no %s key", namespace, name, EXCEPTIONS_CONFIGMAP_KEY)
+	}
+	return ParseConf([]byte(data))
+}
+
+// Explain walks through every decision the detectors make for the objects of a namespace,
+// including the objects that do not affect any label. Each object is evaluated on its own by
+// the policy package, and the decisions quote the reasons it gives.
+func Explain(objects NamespaceObjects, exceptions map[string][]string) []string {
+	config := policy.Config{Exceptions: exceptions}
+	decisions := []string{}
+	for _, pod := range objects.Pods {
+		decisions = append(decisions, explainPod(config, pod))
+	}
+	for _, roleBinding := range objects.RoleBindings {
+		for _, subject := range roleBinding.Subjects {
+			decisions = append(decisions, explainSubject(config, roleBinding, subject))
+		}
+	}
+	for _, pvc := range objects.PersistentVolumeClaims {
+		decisions = append(decisions, explainPVC(config, pvc))
+	}
+	return decisions
+}
+
+func explainPod(config policy.Config, pod *corev1.Pod) string {
+	state, reasons := policy.Evaluate(policy.Inputs{Pods: []*corev1.Pod{pod}}, config)
+	if state.HasSasNotebookFeature {
+		return fmt.Sprintf("pod %s has a SAS notebook: %s", pod.Name, strings.Join(reasons[HAS_SAS_NOTEBOOK_FEATURE_LABEL], "; "))
+	}
+	return fmt.Sprintf("pod %s has no SAS notebook: %s", pod.Name, strings.Join(reasons[HAS_SAS_NOTEBOOK_FEATURE_LABEL], "; "))
+}
+
+// explainSubject evaluates a RoleBinding that only holds the subject, and tells for each user
+// label whether the subject sets it and why
+func explainSubject(config policy.Config, roleBinding *rbacv1.RoleBinding, subject rbacv1.Subject) string {
+	single := roleBinding.DeepCopy()
+	single.Subjects = []rbacv1.Subject{subject}
+	state, reasons := policy.Evaluate(policy.Inputs{RoleBindings: []*rbacv1.RoleBinding{single}}, config)
+
+	steps := []string{}
+	for _, label := range []struct {
+		name          string
+		set           bool
+		exceptionList string
+	}{
+		{NON_EMPLOYEE_USER, state.NonEmployeeUsers, ""},
+		{EXISTS_NON_SAS_NOTEBOOK_USER_LABEL, state.ExistsNonSasNotebookUser, policy.SAS_NOTEBOOK_EXCEPTIONS},
+		{EXISTS_NON_CLOUD_MAIN_USER_LABEL, state.ExistsNonCloudMainUser, policy.CLOUD_MAIN_EXCEPTIONS},
+	} {
+		reason := strings.Join(reasons[label.name], "; ")
+		switch {
+		case label.set:
+			steps = append(steps, fmt.Sprintf("%s, so it sets %s", reason, label.name))
+		case label.exceptionList != "" && state.NonEmployeeUsers && config.Excepted(label.exceptionList, subject.Name):
+			steps = append(steps, fmt.Sprintf("is in %s, so it does not set %s", label.exceptionList, label.name))
+		default:
+			steps = append(steps, fmt.Sprintf("%s, so it does not set %s", reason, label.name))
+		}
+	}
+	return fmt.Sprintf("%s %s in RoleBinding %s: %s", subject.Kind, subject.Name, roleBinding.Name, strings.Join(steps, "; "))
+}
+
+func explainPVC(config policy.Config, pvc *corev1.PersistentVolumeClaim) string {
+	state, reasons := policy.Evaluate(policy.Inputs{PersistentVolumeClaims: []*corev1.PersistentVolumeClaim{pvc}}, config)
+	if state.ExistsInternalBlobStorage {
+		return fmt.Sprintf("PVC %s is internal storage: %s", pvc.Name, strings.Join(reasons[EXISTS_INTERNAL_BLOB_STORAGE], "; "))
+	}
+	return fmt.Sprintf("PVC %s is not internal storage: %s", pvc.Name, strings.Join(reasons[EXISTS_INTERNAL_BLOB_STORAGE], "; "))
+}
@@ -0,0 +1,99 @@
+/*
+These tests fetch a namespace from a fake clientset and walk through the decisions, as the explain command does.
+*/
+
+package controller
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// Build a fake clientset with the RoleBindings of namespace sam from tests/4 and the exceptions ConfigMap
+func newExplainClientset(t *testing.T) *fake.Clientset {
+	objects := []runtime.Object{
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "non-employee-exceptions", Namespace: "statcan-system"},
+			Data: map[string]string{
+				EXCEPTIONS_CONFIGMAP_KEY: "sasNotebookExceptions:\n- test@external.ca\n",
+			},
+		},
+	}
+	rolebindings, err := getRolebindings(filepath.Join(TEST_DIRECTORY, "4"))
+	if err != nil {
+		t.Fatalf("Failed to load rolebindings: %v", err)
+	}
+	for _, rolebinding := range rolebindings {
+		objects = append(objects, rolebinding)
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+func TestFetchExceptionsFromConfigMap(t *testing.T) {
+	exceptions, err := FetchExceptions(context.Background(), newExplainClientset(t), "statcan-system", "non-employee-exceptions")
+	if err != nil {
+		t.Fatalf("FetchExceptions failed: %v", err)
+	}
+	if len(exceptions["sasNotebookExceptions"]) != 1 || exceptions["sasNotebookExceptions"][0] != "test@external.ca" {
+		t.Fatalf("Expected test@external.ca in sasNotebookExceptions but got %v", exceptions)
+	}
+}
+
+// The external user of namespace sam is a non-employee, excepted for SAS but not for cloud main
+func TestExplainWalksThroughEverySubject(t *testing.T) {
+	client := newExplainClientset(t)
+	objects, err := FetchNamespaceObjects(context.Background(), client, "sam")
+	if err != nil {
+		t.Fatalf("FetchNamespaceObjects failed: %v", err)
+	}
+	exceptions, _ := FetchExceptions(context.Background(), client, "statcan-system", "non-employee-exceptions")
+
+	decisions := Explain(objects, exceptions)
+	if len(decisions) != 2 {
+		t.Fatalf("Expected a decision for each of the 2 subjects but got %v", decisions)
+	}
+
+	external := ""
+	for _, decision := range decisions {
+		if strings.Contains(decision, "test@external.ca") {
+			external = decision
+		}
+	}
+	for _, expected := range []string{
+		"domain external.ca is not one of the employee domains",
+		"is in sasNotebookExceptions, so it does not set " + EXISTS_NON_SAS_NOTEBOOK_USER_LABEL,
+		"is not in cloudMainExceptions, so it sets " + EXISTS_NON_CLOUD_MAIN_USER_LABEL,
+	} {
+		if !strings.Contains(external, expected) {
+			t.Errorf("Expected the decision for test@external.ca to contain %q but got %q", expected, external)
+		}
+	}
+}
+
+// The decisions about pods and PVCs quote the reasons of the policy package
+func TestExplainQuotesPolicyReasons(t *testing.T) {
+	manifests, err := LoadManifests(CLUSTER_DIRECTORY)
+	if err != nil {
+		t.Fatalf("Failed to load manifests: %v", err)
+	}
+	objects := manifests.ObjectsIn("alice")
+	objects.PersistentVolumeClaims = append(objects.PersistentVolumeClaims, &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "iunc-data", Namespace: "alice"}})
+
+	decisions := strings.Join(Explain(objects, nil), "\n")
+	for _, expected := range []string{
+		"pod alice-true has a SAS notebook: pod alice/alice-true runs the SAS image " + SAS_PREFIX,
+		"pod alice-false has no SAS notebook: no pod runs an image starting with " + SAS_PREFIX,
+		"PVC iunc-data is internal storage: PVC alice/iunc-data mounts an internal bucket",
+	} {
+		if !strings.Contains(decisions, expected) {
+			t.Errorf("Expected the decisions to contain %q but got:\n%s", expected, decisions)
+		}
+	}
+}
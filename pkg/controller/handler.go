@@ -2,34 +2,36 @@ package controller
 
 import (
 	"context"
-	"strconv"
-	"strings"
 
 	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
 	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/audit"
+	"github.com/statcan/profile-state-controller/pkg/policy"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
-const SAS_PREFIX = "k8scc01covidacr.azurecr.io/sas:"
+const SAS_PREFIX = policy.SAS_PREFIX
 
 // Declare capability labels
-const HAS_SAS_NOTEBOOK_FEATURE_LABEL = "state.aaw.statcan.gc.ca/has-sas-notebook-feature"
-const EXISTS_NON_SAS_NOTEBOOK_USER_LABEL = "state.aaw.statcan.gc.ca/exists-non-sas-notebook-user"
-const EXISTS_NON_CLOUD_MAIN_USER_LABEL = "state.aaw.statcan.gc.ca/exists-non-cloud-main-user"
-const EXISTS_INTERNAL_BLOB_STORAGE = "state.aaw.statcan.gc.ca/exists-internal-blob-storage"
-const NON_EMPLOYEE_USER = "state.aaw.statcan.gc.ca/non-employee-users"
-
-var employeeDomains [2]string = [2]string{"cloud.statcan.ca", "statcan.gc.ca"}
-
-func internalUser(email string) bool {
-	for _, domain := range employeeDomains {
-		if strings.HasSuffix(email, domain) {
-			return true
-		}
-	}
-	return false
+const HAS_SAS_NOTEBOOK_FEATURE_LABEL = policy.HAS_SAS_NOTEBOOK_FEATURE_LABEL
+const EXISTS_NON_SAS_NOTEBOOK_USER_LABEL = policy.EXISTS_NON_SAS_NOTEBOOK_USER_LABEL
+const EXISTS_NON_CLOUD_MAIN_USER_LABEL = policy.EXISTS_NON_CLOUD_MAIN_USER_LABEL
+const EXISTS_INTERNAL_BLOB_STORAGE = policy.EXISTS_INTERNAL_BLOB_STORAGE
+const NON_EMPLOYEE_USER = policy.NON_EMPLOYEE_USER
+
+// The detectors below are implemented by the policy package, with the exceptions configuration of the controller
+
+// policyConfig is the configuration of the policy package
+func (c *Controller) policyConfig() policy.Config {
+	return policy.Config{Exceptions: c.nonEmployeeExceptions}
+}
+
+// roleBindingState evaluates the policy on RoleBindings only
+func (c *Controller) roleBindingState(roleBindings ...*rbacv1.RoleBinding) policy.State {
+	state, _ := policy.Evaluate(policy.Inputs{RoleBindings: roleBindings}, c.policyConfig())
+	return state
 }
 
 //  ____    _    ____    _   _       _       _                 _
@@ -39,80 +41,33 @@ func internalUser(email string) bool {
 // |____/_/   \_\____/  |_| \_|\___/ \__\___|_.__/ \___/ \___/|_|\_\
 
 func sasImage(pod *corev1.Pod) bool {
-
-	for _, container := range pod.Spec.Containers {
-		sasImage := strings.HasPrefix(container.Image, SAS_PREFIX)
-		if sasImage {
-			return true
-		}
-	}
-
-	return false
+	return policy.SasImage(pod)
 }
 
-func (c *Controller) subjectInSasNotebookExceptionList(subject string) bool {
-	for _, exceptionCase := range c.nonEmployeeExceptions["sasNotebookExceptions"] {
-		if subject == strings.TrimSpace(exceptionCase) {
-			return true
-		}
-	}
-	log.Infof("Found unexcepted SAS user %v", subject)
-	return false
+func (c *Controller) rolebindingContainsNonSasUser(rolebinding *rbacv1.RoleBinding) bool {
+	return c.roleBindingState(rolebinding).ExistsNonSasNotebookUser
 }
 
-func (c *Controller) rolebindingContainsNonSasUser(rolebinding *rbacv1.RoleBinding) bool {
-	for _, subject := range rolebinding.Subjects {
-		// If subject.Kind is not a user, then nothing below applies
-		if subject.Kind != "User" {
-			continue
-		}
-		// If the subject contains a Statcan employee email, there is nothing more to check.
-		// Continue to the next iteration
-		email := subject.Name
-		if strings.Contains(email, "@") {
-			if internalUser(email) {
-				continue
+// nonSasUsers lists the subjects that make existsNonSasUser return true
+func (c *Controller) nonSasUsers(roleBindings []*rbacv1.RoleBinding) []string {
+	subjects := []string{}
+	for _, roleBinding := range roleBindings {
+		for _, subject := range roleBinding.Subjects {
+			if c.policyConfig().NonSasUser(subject) {
+				subjects = append(subjects, subject.Name)
 			}
 		}
-		// If the subject is in the exception list for SAS users, then we can continue to the next
-		// iteration
-		if c.subjectInSasNotebookExceptionList(subject.Name) {
-			continue
-		}
-		// If we get to this point, the user is not a statcan employee and the user has not
-		// been granted an exception to use the SAS feeature. This is a sufficient condition
-		// for rolebindingContainsNonSasUser to return true.
-		return true
 	}
-	return false
+	return subjects
 }
 
 func (c *Controller) hasSasNotebookFeature(pods []*corev1.Pod) bool {
-	// label to set
-	hasSasNotebookFeature := false
-
-	for _, pod := range pods {
-		if sasImage(pod) {
-			hasSasNotebookFeature = true
-			break
-		}
-	}
-
-	return hasSasNotebookFeature
+	state, _ := policy.Evaluate(policy.Inputs{Pods: pods}, c.policyConfig())
+	return state.HasSasNotebookFeature
 }
 
 func (c *Controller) existsNonSasUser(roleBindings []*rbacv1.RoleBinding) bool {
-	// label to set
-	nonSasUser := false
-
-	for _, roleBinding := range roleBindings {
-		if c.rolebindingContainsNonSasUser(roleBinding) {
-			nonSasUser = true
-			break
-		}
-	}
-
-	return nonSasUser
+	return c.roleBindingState(roleBindings...).ExistsNonSasNotebookUser
 }
 
 //       _                 _                   _
@@ -121,55 +76,8 @@ func (c *Controller) existsNonSasUser(roleBindings []*rbacv1.RoleBinding) bool {
 // | (__| | (_) | |_| | (_| | | | | | | | (_| | | | | |
 //  \___|_|\___/ \__,_|\__,_| |_| |_| |_|\__,_|_|_| |_|
 
-func (c *Controller) subjectInCloudMainExceptionList(subject string) bool {
-	for _, exceptionCase := range c.nonEmployeeExceptions["cloudMainExceptions"] {
-		if subject == strings.TrimSpace(exceptionCase) {
-			return true
-		}
-	}
-	log.Infof("Found unexcepted cloudmain user %v", subject)
-	return false
-}
-
-func (c *Controller) rolebindingContainsNonCloudMainUser(rolebinding *rbacv1.RoleBinding) bool {
-	for _, subject := range rolebinding.Subjects {
-		// If subject.Kind is not a user, then nothing below applies
-		if subject.Kind != "User" {
-			continue
-		}
-		// If the subject contains a Statcan employee email, there is nothing more to check.
-		// Continue to the next iteration
-		email := subject.Name
-		if strings.Contains(email, "@") {
-			if internalUser(email) {
-				continue
-			}
-		}
-		// If the subject is in the exception list for SAS users, then we can continue to the next
-		// iteration
-		if c.subjectInCloudMainExceptionList(subject.Name) {
-			continue
-		}
-		// If we get to this point, the user is not a statcan employee and the user has not
-		// been granted an exception to use the SAS feeature. This is a sufficient condition
-		// for rolebindingContainsNonSasUser to return true.
-		return true
-	}
-	return false
-}
-
 func (c *Controller) existsNonCloudMainUser(roleBindings []*rbacv1.RoleBinding) bool {
-	// label to set
-	nonCloudMainUser := false
-
-	for _, roleBinding := range roleBindings {
-		if c.rolebindingContainsNonCloudMainUser(roleBinding) {
-			nonCloudMainUser = true
-			break
-		}
-	}
-
-	return nonCloudMainUser
+	return c.roleBindingState(roleBindings...).ExistsNonCloudMainUser
 }
 
 //	 ___  _     ___   ___
@@ -181,57 +89,23 @@ func (c *Controller) existsNonCloudMainUser(roleBindings []*rbacv1.RoleBinding)
 // Case 1 is an Internal bucket is already mounted, if a pvc exists with "iprotb" or "iunc" in it's name
 // we know there's an internal bucket mounted and external users should be prevented from accessing it
 func (c *Controller) existsInternalCommonStorage(pvcSlice []*corev1.PersistentVolumeClaim) bool {
-
-	for _, pvc := range pvcSlice {
-		if c.internalPVC(pvc.Name) {
-			return true
-		} else {
-			continue
-		}
-	}
-	return false
+	state, _ := policy.Evaluate(policy.Inputs{PersistentVolumeClaims: pvcSlice}, c.policyConfig())
+	return state.ExistsInternalBlobStorage
 }
 
 // helper func to check for internal bucket name through naming convention
 func (c *Controller) internalPVC(pvcName string) bool {
-	return strings.Contains(pvcName, "iunc") || strings.Contains(pvcName, "iprotb")
+	return policy.InternalPVC(pvcName)
 }
 
-// possible to dissolve this into an above function to improve performance
 func (c *Controller) roleBindingContainsNonEmployee(roleBinding *rbacv1.RoleBinding) bool {
-
-	for _, subject := range roleBinding.Subjects {
-		// If subject.Kind is not a user, then nothing below applies
-		if subject.Kind != "User" {
-			continue
-		}
-		// If the subject contains a Statcan employee email, there is nothing more to check.
-		// Continue to the next iteration
-		email := subject.Name
-		if strings.Contains(email, "@") {
-			if internalUser(email) {
-				continue
-			} else {
-				// we only need this case to be satisfied once per namespace to know that an external user exists
-				return true
-			}
-		}
-	}
-	return false
+	return c.roleBindingState(roleBinding).NonEmployeeUsers
 }
 
 // Case 2 is an external employee already exists and an internal bucket is to be created.
 // Blob csi controller would check this label and if true, would not create the PV/C
 func (c *Controller) existsNonEmployee(roleBindings []*rbacv1.RoleBinding) bool {
-	nonEmployee := false
-
-	for _, roleBinding := range roleBindings {
-		if c.roleBindingContainsNonEmployee(roleBinding) {
-			nonEmployee = true
-			break
-		}
-	}
-	return nonEmployee
+	return c.roleBindingState(roleBindings...).NonEmployeeUsers
 }
 
 //              _                     _ _
@@ -240,48 +114,126 @@ func (c *Controller) existsNonEmployee(roleBindings []*rbacv1.RoleBinding) bool
 // | | | \__ \ | | | | (_| | | | | (_| | |  __/ |
 // |_| |_|___/ |_| |_|\__,_|_| |_|\__,_|_|\___|_|
 
-func (c *Controller) handleProfileAndNamespace(profile *v1.Profile, namespace *corev1.Namespace, feats []bool) error {
-	// set namespace labels
-	if namespace.Labels == nil {
-		namespace.Labels = make(map[string]string)
+func (c *Controller) handleProfileAndNamespace(profile *v1.Profile, namespace *corev1.Namespace, feats []bool, reasons policy.Reasons, trigger string, record *audit.Record) error {
+	// The profile and namespace come from the informer cache and must not be modified.
+	// Only the managed labels are sent to the API server, so other writers are not overwritten.
+	desired := desiredLabels(feats)
+	profileTransitions := stateTransitions(profile.Labels, desired)
+	namespaceTransitions := stateTransitions(namespace.Labels, desired)
+
+	if c.options.DryRun {
+		reportDryRun("profile", profile.Name, profileTransitions, trigger)
+		reportDryRun("namespace", namespace.Name, namespaceTransitions, trigger)
+		return nil
 	}
-	// set Profile labels
-	if profile.Labels == nil {
-		profile.Labels = make(map[string]string)
+
+	// When the computed state is the same as last time, any difference was introduced by hand
+	last, synced := c.getLastState(profile.Name)
+	drifted := synced && len(stateTransitions(last, desired)) == 0
+	if !synced {
+		// The profile holds the state recorded before this process started. It is remembered
+		// before writing, so that a retry after a failed namespace patch still records the
+		// transitions although the profile was already patched.
+		last = managedLabels(profile.Labels)
+		c.setLastState(profile.Name, last)
 	}
-	// Update profile labels
-	profile.Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] = strconv.FormatBool(feats[0])
-	profile.Labels[EXISTS_NON_SAS_NOTEBOOK_USER_LABEL] = strconv.FormatBool(feats[1])
-	profile.Labels[EXISTS_NON_CLOUD_MAIN_USER_LABEL] = strconv.FormatBool(feats[2])
-	profile.Labels[NON_EMPLOYEE_USER] = strconv.FormatBool(feats[3])
-	profile.Labels[EXISTS_INTERNAL_BLOB_STORAGE] = strconv.FormatBool(feats[4])
-
-	// Update namespace labels
-	namespace.Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] = strconv.FormatBool(feats[0])
-	namespace.Labels[EXISTS_NON_SAS_NOTEBOOK_USER_LABEL] = strconv.FormatBool(feats[1])
-	namespace.Labels[EXISTS_NON_CLOUD_MAIN_USER_LABEL] = strconv.FormatBool(feats[2])
-	namespace.Labels[NON_EMPLOYEE_USER] = strconv.FormatBool(feats[3])
-	namespace.Labels[EXISTS_INTERNAL_BLOB_STORAGE] = strconv.FormatBool(feats[4])
+	transitions := stateTransitions(last, desired)
+	c.setPendingState(profile.Name, desired)
 
 	ctx := context.Background()
-	// Update profile and namespace resources
-	_, err := c.kubeflowClientset.KubeflowV1().Profiles().Update(ctx, profile, metav1.UpdateOptions{})
+	// Patch profile and namespace resources, skipping the write when the labels already match
+	if len(profileTransitions) > 0 {
+		updatedProfile, err := c.patchProfileLabels(ctx, profile, desired)
+
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Updated profile %v with labels hasSasNotebookFeature=%t existsNonSasUser=%t existsNonCloudMainUser=%t nonEmployee=%t existsInternalBlobStorage=%t",
+			namespace.Name, feats[0], feats[1], feats[2], feats[3], feats[4])
+
+		profile = updatedProfile
+		record.Written = append(record.Written, audit.Write{Resource: "profile", Name: profile.Name, Labels: desired})
+	} else {
+		recordSkippedWrite("profile")
+	}
+
+	if len(namespaceTransitions) > 0 {
+		updatedNamespace, err := c.patchNamespaceLabels(ctx, namespace, desired)
+
+		if err != nil {
+			return err
+		}
 
+		log.Infof("Updated namespace %v with labels hasSasNotebookFeature=%t existsNonSasUser=%t existsNonCloudMainUser=%t nonEmployee=%t existsInternalBlobStorage=%t",
+			namespace.Name, feats[0], feats[1], feats[2], feats[3], feats[4])
+
+		namespace = updatedNamespace
+		record.Written = append(record.Written, audit.Write{Resource: "namespace", Name: namespace.Name, Labels: desired})
+	} else {
+		recordSkippedWrite("namespace")
+	}
+
+	c.setLastState(profile.Name, desired)
+
+	if !drifted {
+		c.recordTransitions(profile, namespace, transitions, desired, trigger)
+		c.recordHistory(profile, transitions, reasons, trigger)
+		return nil
+	}
+	if len(profileTransitions) > 0 {
+		c.recordDriftCorrection(profile, "profile", profile.Name, profileTransitions)
+	}
+	if len(namespaceTransitions) > 0 {
+		c.recordDriftCorrection(namespace, "namespace", namespace.Name, namespaceTransitions)
+	}
+
+	return nil
+}
+
+// handleDeletedProfile removes the managed labels from a Namespace that outlives its Profile,
+// when enabled. Namespaces that are being deleted along with their Profile are left alone.
+func (c *Controller) handleDeletedProfile(name string, record *audit.Record) error {
+	if !c.options.CleanupOrphanedNamespaces {
+		return nil
+	}
+
+	namespace, err := c.namespaceInformerLister.Lister().Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	if namespace.DeletionTimestamp != nil {
+		return nil
+	}
 
-	log.Infof("Updated profile %v with labels hasSasNotebookFeature=%t existsNonSasUser=%t existsNonCloudMainUser=%t nonEmployee=%t existsInternalBlobStorage=%t",
-		namespace.Name, feats[0], feats[1], feats[2], feats[3], feats[4])
+	managed := []string{}
+	for _, label := range stateLabels {
+		if _, ok := namespace.Labels[label]; ok {
+			managed = append(managed, label)
+		}
+	}
+	if len(managed) == 0 {
+		return nil
+	}
 
-	_, err = c.kubeclientset.CoreV1().Namespaces().Update(ctx, namespace, metav1.UpdateOptions{})
+	if c.options.DryRun {
+		removals := []stateTransition{}
+		for _, label := range managed {
+			removals = append(removals, stateTransition{label: label, oldValue: namespace.Labels[label]})
+		}
+		reportDryRun("namespace", name, removals, "Profile "+name+" deletion")
+		return nil
+	}
 
+	_, err = c.removeNamespaceLabels(context.Background(), namespace, managed)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Updated namespace %v with labels hasSasNotebookFeature=%t existsNonSasUser=%t existsNonCloudMainUser=%t nonEmployee=%t existsInternalBlobStorage=%t",
-		namespace.Name, feats[0], feats[1], feats[2], feats[3], feats[4])
-
+	record.Written = append(record.Written, audit.Write{Resource: "namespace", Name: name, Removed: managed})
+	log.Infof("Removed labels %v from namespace %v as its profile was deleted", managed, name)
 	return nil
 }
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// cachesSynced lists the HasSynced functions of every informer the controller reads from
+func (c *Controller) cachesSynced() []cache.InformerSynced {
+	return []cache.InformerSynced{
+		c.podSynched,
+		c.profileSynched,
+		c.namespaceSynced,
+		c.roleBindingSynced,
+		c.persistentVolumeClaimSynced,
+	}
+}
+
+// hasSynced returns true once every informer cache has been filled
+func (c *Controller) hasSynced() bool {
+	for _, synced := range c.cachesSynced() {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// markSyncFinished records the time at which a worker last finished processing an item
+func (c *Controller) markSyncFinished() {
+	atomic.StoreInt64(&c.lastSyncTime, time.Now().UnixNano())
+}
+
+// markQueued records when the workqueue stopped being empty, unless it already has items
+func (c *Controller) markQueued() {
+	atomic.CompareAndSwapInt64(&c.queuedSince, 0, time.Now().UnixNano())
+}
+
+// markQueueDrained forgets when the workqueue stopped being empty once a worker takes its last item
+func (c *Controller) markQueueDrained() {
+	atomic.StoreInt64(&c.queuedSince, 0)
+}
+
+// readinessProblems returns the reasons the controller is not ready to serve, if any
+func (c *Controller) readinessProblems() []string {
+	problems := []string{}
+
+	if !c.hasSynced() {
+		problems = append(problems, "informer caches are not synced")
+	}
+	if c.exceptionsErr != nil {
+		problems = append(problems, fmt.Sprintf("exceptions configuration failed to load: %v", c.exceptionsErr))
+	}
+	if atomic.LoadInt32(&c.workersRunning) == 0 && !c.options.LeaderElection {
+		problems = append(problems, "workers are not running")
+	}
+
+	return problems
+}
+
+// livenessProblems returns the reasons the controller should be restarted, if any.
+// A worker is considered stuck when items are waiting in the queue but no sync has
+// finished within the configured timeout, counted from the later of the last finished
+// sync and the time the queue stopped being empty, so that an idle period does not count.
+func (c *Controller) livenessProblems() []string {
+	problems := []string{}
+
+	if c.options.WorkerStuckTimeout <= 0 || atomic.LoadInt32(&c.workersRunning) == 0 {
+		return problems
+	}
+
+	queued := c.workqueue.Len()
+	if queued == 0 {
+		return problems
+	}
+	queuedSince := atomic.LoadInt64(&c.queuedSince)
+	if queuedSince == 0 {
+		// Rate limited retries are added by the workqueue itself, so start counting now
+		c.markQueued()
+		return problems
+	}
+
+	waitingSince := time.Unix(0, atomic.LoadInt64(&c.lastSyncTime))
+	if queuedAt := time.Unix(0, queuedSince); queuedAt.After(waitingSince) {
+		waitingSince = queuedAt
+	}
+	if time.Since(waitingSince) > c.options.WorkerStuckTimeout {
+		problems = append(problems, fmt.Sprintf("no sync finished since %v while %d items are queued",
+			waitingSince.Format(time.RFC3339), queued))
+	}
+
+	return problems
+}
+
+// Healthz is the liveness probe handler
+func (c *Controller) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeProbeResult(w, c.livenessProblems())
+}
+
+// Readyz is the readiness probe handler
+func (c *Controller) Readyz(w http.ResponseWriter, r *http.Request) {
+	writeProbeResult(w, c.readinessProblems())
+}
+
+func writeProbeResult(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
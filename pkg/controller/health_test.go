@@ -0,0 +1,111 @@
+/*
+These tests check the reasons returned by the liveness and readiness probes.
+*/
+
+package controller
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLivenessProblems(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name           string
+		timeout        time.Duration
+		workersRunning bool
+		queued         bool
+		lastSync       time.Time
+		queuedSince    time.Time
+		stuck          bool
+	}{
+		{name: "check disabled", timeout: 0, workersRunning: true, queued: true, lastSync: now.Add(-time.Hour), queuedSince: now.Add(-time.Hour)},
+		{name: "workers not running", timeout: time.Minute, workersRunning: false, queued: true, lastSync: now.Add(-time.Hour), queuedSince: now.Add(-time.Hour)},
+		{name: "idle with an empty queue", timeout: time.Minute, workersRunning: true, lastSync: now.Add(-time.Hour)},
+		{name: "item queued after an idle period", timeout: time.Minute, workersRunning: true, queued: true, lastSync: now.Add(-time.Hour), queuedSince: now.Add(-time.Second)},
+		{name: "item queued while syncs finish", timeout: time.Minute, workersRunning: true, queued: true, lastSync: now.Add(-time.Second), queuedSince: now.Add(-time.Hour)},
+		{name: "no sync finished since the queue filled up", timeout: time.Minute, workersRunning: true, queued: true, lastSync: now.Add(-time.Hour), queuedSince: now.Add(-2 * time.Minute), stuck: true},
+		{name: "retry added by the workqueue", timeout: time.Minute, workersRunning: true, queued: true, lastSync: now.Add(-time.Hour)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newMockListerController(t)
+			c.options.WorkerStuckTimeout = test.timeout
+			if test.workersRunning {
+				atomic.StoreInt32(&c.workersRunning, 1)
+			}
+			if test.queued {
+				c.workqueue.Add("alice")
+			}
+			atomic.StoreInt64(&c.lastSyncTime, test.lastSync.UnixNano())
+			if !test.queuedSince.IsZero() {
+				atomic.StoreInt64(&c.queuedSince, test.queuedSince.UnixNano())
+			}
+
+			problems := c.livenessProblems()
+			if test.stuck != (len(problems) > 0) {
+				t.Fatalf("expected stuck=%v, got problems %v", test.stuck, problems)
+			}
+			if test.stuck && !strings.Contains(problems[0], "while 1 items are queued") {
+				t.Errorf("unexpected problem %q", problems[0])
+			}
+		})
+	}
+}
+
+func TestLivenessStartsCountingRetriesWhenSeen(t *testing.T) {
+	c := newMockListerController(t)
+	c.options.WorkerStuckTimeout = time.Minute
+	atomic.StoreInt32(&c.workersRunning, 1)
+	c.workqueue.Add("alice")
+
+	before := time.Now()
+	if problems := c.livenessProblems(); len(problems) > 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+	if queuedSince := time.Unix(0, atomic.LoadInt64(&c.queuedSince)); queuedSince.Before(before) {
+		t.Errorf("expected the queue to be timed from the probe, got %v", queuedSince)
+	}
+}
+
+func TestReadinessProblems(t *testing.T) {
+	tests := []struct {
+		name           string
+		synced         bool
+		exceptionsErr  error
+		workersRunning bool
+		leaderElection bool
+		expected       []string
+	}{
+		{name: "ready", synced: true, workersRunning: true, expected: []string{}},
+		{name: "caches not synced", synced: false, workersRunning: true, expected: []string{"informer caches are not synced"}},
+		{name: "exceptions failed to load", synced: true, exceptionsErr: errors.New("bad yaml"), workersRunning: true,
+			expected: []string{"exceptions configuration failed to load: bad yaml"}},
+		{name: "workers not running", synced: true, expected: []string{"workers are not running"}},
+		{name: "waiting for leadership", synced: true, leaderElection: true, expected: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newMockListerController(t)
+			if !test.synced {
+				c.podSynched = func() bool { return false }
+			}
+			c.exceptionsErr = test.exceptionsErr
+			c.options.LeaderElection = test.leaderElection
+			if test.workersRunning {
+				atomic.StoreInt32(&c.workersRunning, 1)
+			}
+
+			if problems := c.readinessProblems(); !reflect.DeepEqual(problems, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, problems)
+			}
+		})
+	}
+}
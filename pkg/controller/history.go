@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/history"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordHistory appends the transitions of a profile's labels to its history, when enabled.
+// The labels are already written, so a failure is logged rather than retried.
+func (c *Controller) recordHistory(profile *v1.Profile, transitions []stateTransition, reasons policy.Reasons, trigger string) {
+	if c.history == nil || len(transitions) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	entries := []history.Entry{}
+	for _, transition := range transitions {
+		entries = append(entries, history.Entry{
+			Time:    now,
+			Label:   transition.label,
+			From:    transition.oldValue,
+			To:      transition.newValue,
+			Trigger: trigger,
+			Reasons: reasons[transition.label],
+		})
+	}
+	owner := metav1.OwnerReference{
+		APIVersion: v1.SchemeGroupVersion.String(),
+		Kind:       "Profile",
+		Name:       profile.Name,
+		UID:        profile.UID,
+	}
+	if err := c.history.Append(context.Background(), profile.Name, owner, entries); err != nil {
+		log.Errorf("failed to record the history of profile %v: %v", profile.Name, err)
+	}
+}
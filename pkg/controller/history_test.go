@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	"github.com/statcan/profile-state-controller/pkg/history"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRecordHistory(t *testing.T) {
+	c := newMockListerController(t)
+	c.history = history.NewStore(c.kubeclientset, history.Options{Namespace: "statcan-system", Limit: 10})
+
+	objects, _ := c.namespaceObjects("sam")
+	_, reasons := policy.Evaluate(objects, c.policyConfig())
+	transitions := stateTransitions(map[string]string{NON_EMPLOYEE_USER: "false"}, map[string]string{NON_EMPLOYEE_USER: "true"})
+	c.recordHistory(&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "sam"}}, transitions, reasons, "RoleBinding sam/user-test-external")
+
+	entries, err := c.history.List(context.Background(), "sam")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry but got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Label != NON_EMPLOYEE_USER || entry.From != "false" || entry.To != "true" || entry.Trigger != "RoleBinding sam/user-test-external" {
+		t.Errorf("Expected the transition of non-employee-users but got %+v", entry)
+	}
+	if len(entry.Reasons) != 1 || entry.Reasons[0] != reasons[NON_EMPLOYEE_USER][0] {
+		t.Errorf("Expected the reasons of non-employee-users but got %v", entry.Reasons)
+	}
+}
+
+// Nothing is written when history is disabled or when no label changed
+func TestRecordHistorySkipped(t *testing.T) {
+	c := newMockListerController(t)
+	profile := &v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "sam"}}
+	c.recordHistory(profile, []stateTransition{{label: NON_EMPLOYEE_USER, newValue: "true"}}, policy.Reasons{}, "test")
+
+	c.history = history.NewStore(c.kubeclientset, history.Options{Namespace: "statcan-system"})
+	c.recordHistory(profile, []stateTransition{}, policy.Reasons{}, "test")
+
+	configMaps, _ := c.kubeclientset.CoreV1().ConfigMaps("statcan-system").List(context.Background(), metav1.ListOptions{})
+	if len(configMaps.Items) != 0 {
+		t.Fatalf("Expected no history ConfigMap but got %d", len(configMaps.Items))
+	}
+}
+
+// A namespace patch that fails after the profile was patched must not lose the history, and the
+// history is owned by the profile
+func TestHistoryRecordedAfterFailedNamespacePatch(t *testing.T) {
+	c, kubeclientset := newMockSyncController(t)
+	c.history = history.NewStore(kubeclientset, history.Options{Namespace: "statcan-system"})
+	failed := false
+	kubeclientset.PrependReactor("patch", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, fmt.Errorf("namespace patch failed")
+	})
+
+	if err := c.syncHandler("alice"); err == nil {
+		t.Fatalf("Expected the first sync to fail")
+	}
+	profile, err := c.kubeflowClientset.KubeflowV1().Profiles().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched profile: %v", err)
+	}
+	c.profileInformerLister.Informer().GetIndexer().Update(profile)
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+
+	entries, err := c.history.List(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != len(stateLabels) {
+		t.Fatalf("Expected one entry per state label but got %+v", entries)
+	}
+	configMap, err := kubeclientset.CoreV1().ConfigMaps("statcan-system").Get(context.Background(), history.ConfigMapName("alice"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected a history ConfigMap: %v", err)
+	}
+	if len(configMap.OwnerReferences) != 1 || configMap.OwnerReferences[0].Kind != "Profile" || configMap.OwnerReferences[0].Name != "alice" {
+		t.Errorf("Expected the history to be owned by profile alice but got %v", configMap.OwnerReferences)
+	}
+}
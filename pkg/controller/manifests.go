@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	kubeflowscheme "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned/scheme"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// Manifests holds the Profiles and namespaced objects read from YAML files
+type Manifests struct {
+	Profiles []*v1.Profile
+	Objects  map[string]*NamespaceObjects
+}
+
+// Namespaces lists every namespace with a Profile or with objects, sorted by name
+func (m *Manifests) Namespaces() []string {
+	seen := map[string]bool{}
+	for _, profile := range m.Profiles {
+		seen[profile.Name] = true
+	}
+	for namespace := range m.Objects {
+		seen[namespace] = true
+	}
+	namespaces := []string{}
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// ObjectsIn returns the objects of a namespace, which are empty when none were read
+func (m *Manifests) ObjectsIn(namespace string) NamespaceObjects {
+	if objects, ok := m.Objects[namespace]; ok {
+		return *objects
+	}
+	return NamespaceObjects{}
+}
+
+// LookupObjects is ObjectsIn in the form expected by BuildReport
+func (m *Manifests) LookupObjects(namespace string) (NamespaceObjects, error) {
+	return m.ObjectsIn(namespace), nil
+}
+
+func (m *Manifests) objectsIn(namespace string) *NamespaceObjects {
+	// Like kubectl apply, objects without a namespace go to the default namespace
+	if namespace == "" {
+		namespace = corev1.NamespaceDefault
+	}
+	if _, ok := m.Objects[namespace]; !ok {
+		m.Objects[namespace] = &NamespaceObjects{}
+	}
+	return m.Objects[namespace]
+}
+
+// LoadManifests reads the Profiles, Pods, RoleBindings and PersistentVolumeClaims from every
+// .yaml, .yml and .json file under dir. Files may contain several documents separated by ---,
+// and the items of a List are read like documents. Objects of other kinds are skipped with a
+// warning, and documents that are not Kubernetes objects are skipped.
+func LoadManifests(dir string) (*Manifests, error) {
+	// Register the Profile types so that they can be decoded
+	utilruntime.Must(kubeflowscheme.AddToScheme(scheme.Scheme))
+
+	manifests := &Manifests{Objects: map[string]*NamespaceObjects{}}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return manifests.loadFile(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifests, nil
+}
+
+func (m *Manifests) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := yaml.NewYAMLReader(bufio.NewReader(file))
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+		if err := m.addDocument(path, document); err != nil {
+			return err
+		}
+	}
+}
+
+// addDocument decodes one document, or one item of a List, read from path
+func (m *Manifests) addDocument(path string, document []byte) error {
+	obj, kind, err := scheme.Codecs.UniversalDeserializer().Decode(document, nil, nil)
+	if runtime.IsMissingKind(err) || runtime.IsMissingVersion(err) {
+		log.Debugf("skipping a document in %s that is not a Kubernetes object", path)
+		return nil
+	}
+	if runtime.IsNotRegisteredError(err) {
+		log.Warnf("skipping an object of unknown kind in %s: %v", path, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	if list, ok := obj.(*corev1.List); ok {
+		for _, item := range list.Items {
+			if err := m.addDocument(path, item.Raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !m.add(obj) {
+		log.Warnf("skipping a %s in %s, as only Profiles, Pods, RoleBindings and PersistentVolumeClaims are evaluated", kind.Kind, path)
+	}
+	return nil
+}
+
+// add keeps an object of one of the kinds the policy looks at, and returns false for other kinds
+func (m *Manifests) add(obj runtime.Object) bool {
+	switch o := obj.(type) {
+	case *v1.Profile:
+		m.Profiles = append(m.Profiles, o)
+	case *corev1.Pod:
+		objects := m.objectsIn(o.Namespace)
+		objects.Pods = append(objects.Pods, o)
+	case *rbacv1.RoleBinding:
+		objects := m.objectsIn(o.Namespace)
+		objects.RoleBindings = append(objects.RoleBindings, o)
+	case *corev1.PersistentVolumeClaim:
+		objects := m.objectsIn(o.Namespace)
+		objects.PersistentVolumeClaims = append(objects.PersistentVolumeClaims, o)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const metricsNamespace = "profile_state_controller"
+
+// Sync and API write metrics
+var (
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken to reconcile a profile, by result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	apiUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_updates_total",
+		Help:      "Number of writes sent to the Kubernetes API, by resource and result.",
+	}, []string{"resource", "result"})
+
+	skippedWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skipped_writes_total",
+		Help:      "Number of writes skipped because the labels already matched, by resource.",
+	}, []string{"resource"})
+)
+
+// Workqueue metrics, following the names used by the Kubernetes controllers
+var (
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Current depth of the workqueue.",
+	}, []string{"name"})
+
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Total number of adds handled by the workqueue.",
+	}, []string{"name"})
+
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long in seconds an item stays in the workqueue before being requested.",
+		Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "How long in seconds processing an item from the workqueue takes.",
+		Buckets:   prometheus.ExponentialBuckets(10e-9, 10, 10),
+	}, []string{"name"})
+
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+	}, []string{"name"})
+
+	workqueueLongestRunningProcessor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "How many seconds has the longest running processor for the workqueue been running.",
+	}, []string{"name"})
+
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Total number of retries handled by the workqueue.",
+	}, []string{"name"})
+)
+
+// RegisterMetrics registers the sync, API write and workqueue metrics and routes the
+// client-go workqueue metrics to them. It has to be called before NewController creates the workqueue.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{
+		syncDuration,
+		apiUpdates,
+		skippedWrites,
+		dryRunDiffs,
+		workqueueDepth,
+		workqueueAdds,
+		workqueueLatency,
+		workqueueWorkDuration,
+		workqueueUnfinishedWork,
+		workqueueLongestRunningProcessor,
+		workqueueRetries,
+	} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	workqueue.SetProvider(workqueueMetricsProvider{})
+	return nil
+}
+
+// RegisterStateMetrics registers the number of profiles in each state, read from the informer cache
+func (c *Controller) RegisterStateMetrics(registerer prometheus.Registerer) error {
+	return registerer.Register(newProfileStateCollector(c))
+}
+
+// workqueueMetricsProvider exposes the client-go workqueue metrics through Prometheus
+type workqueueMetricsProvider struct{}
+
+func (workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunningProcessor.WithLabelValues(name)
+}
+
+func (workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
+
+// recordAPIUpdate counts a write to the Kubernetes API
+func recordAPIUpdate(resource string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	apiUpdates.WithLabelValues(resource, result).Inc()
+}
+
+// recordSkippedWrite counts a write that was not sent because nothing changed
+func recordSkippedWrite(resource string) {
+	skippedWrites.WithLabelValues(resource).Inc()
+}
+
+// profileStateCollector reports how many Profiles currently have each state label set to true.
+// The values are read from the informer cache at scrape time, so they always match the cluster.
+type profileStateCollector struct {
+	controller *Controller
+	desc       *prometheus.Desc
+}
+
+func newProfileStateCollector(c *Controller) *profileStateCollector {
+	return &profileStateCollector{
+		controller: c,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "profiles_with_label"),
+			"Number of Profiles with the given state label set to true.",
+			[]string{"label"}, nil,
+		),
+	}
+}
+
+func (p *profileStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *profileStateCollector) Collect(ch chan<- prometheus.Metric) {
+	profiles, err := p.controller.profileInformerLister.Lister().List(labels.Everything())
+	if err != nil {
+		log.Errorf("failed to list profiles for metrics: %v", err)
+		return
+	}
+
+	counts := make(map[string]int, len(stateLabels))
+	for _, profile := range profiles {
+		for _, label := range stateLabels {
+			if profile.Labels[label] == "true" {
+				counts[label]++
+			}
+		}
+	}
+
+	for _, label := range stateLabels {
+		ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, float64(counts[label]), label)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+These tests check the profile state gauges, read from the informer cache, and the API write counters.
+*/
+
+package controller
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProfileStateCollector(t *testing.T) {
+	c := newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: map[string]string{
+			policy.HAS_SAS_NOTEBOOK_FEATURE_LABEL: "true",
+			policy.NON_EMPLOYEE_USER:              "false",
+		}}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "bob", Labels: map[string]string{
+			policy.HAS_SAS_NOTEBOOK_FEATURE_LABEL: "true",
+			policy.NON_EMPLOYEE_USER:              "true",
+		}}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "jane"}},
+	)
+
+	expected := `
+# HELP profile_state_controller_profiles_with_label Number of Profiles with the given state label set to true.
+# TYPE profile_state_controller_profiles_with_label gauge
+profile_state_controller_profiles_with_label{label="state.aaw.statcan.gc.ca/exists-internal-blob-storage"} 0
+profile_state_controller_profiles_with_label{label="state.aaw.statcan.gc.ca/exists-non-cloud-main-user"} 0
+profile_state_controller_profiles_with_label{label="state.aaw.statcan.gc.ca/exists-non-sas-notebook-user"} 0
+profile_state_controller_profiles_with_label{label="state.aaw.statcan.gc.ca/has-sas-notebook-feature"} 2
+profile_state_controller_profiles_with_label{label="state.aaw.statcan.gc.ca/non-employee-users"} 1
+`
+	if err := testutil.CollectAndCompare(newProfileStateCollector(c), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordAPIUpdate(t *testing.T) {
+	apiUpdates.Reset()
+	defer apiUpdates.Reset()
+
+	recordAPIUpdate("profile", nil)
+	recordAPIUpdate("profile", nil)
+	recordAPIUpdate("namespace", nil)
+	recordAPIUpdate("namespace", errors.New("conflict"))
+
+	expected := `
+# HELP profile_state_controller_api_updates_total Number of writes sent to the Kubernetes API, by resource and result.
+# TYPE profile_state_controller_api_updates_total counter
+profile_state_controller_api_updates_total{resource="namespace",result="failure"} 1
+profile_state_controller_api_updates_total{resource="namespace",result="success"} 1
+profile_state_controller_api_updates_total{resource="profile",result="success"} 2
+`
+	if err := testutil.CollectAndCompare(apiUpdates, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// FIELD_MANAGER identifies the controller's writes in the managedFields of Profiles and Namespaces
+const FIELD_MANAGER = "profile-state-controller"
+
+// labelsMergePatch builds a JSON merge patch that sets only the given labels.
+// Labels that are not in the map are left untouched by the API server. The patch carries the
+// resourceVersion the labels were compared against, so the API server rejects it with a
+// conflict when the object changed in the meantime.
+func labelsMergePatch(resourceVersion string, labels map[string]string) ([]byte, error) {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+			"labels":          labels,
+		},
+	}
+	return json.Marshal(patch)
+}
+
+// labelsRemovalMergePatch builds a JSON merge patch that deletes the given labels, conditional
+// on the resourceVersion like labelsMergePatch
+func labelsRemovalMergePatch(resourceVersion string, labels []string) ([]byte, error) {
+	removed := make(map[string]interface{}, len(labels))
+	for _, label := range labels {
+		removed[label] = nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+			"labels":          removed,
+		},
+	}
+	return json.Marshal(patch)
+}
+
+// patchProfileLabels applies the managed labels to a Profile. On a conflict the Profile is
+// read again, and patched again only if its labels still differ.
+func (c *Controller) patchProfileLabels(ctx context.Context, cached *v1.Profile, labels map[string]string) (*v1.Profile, error) {
+	profiles := c.kubeflowClientset.KubeflowV1().Profiles()
+	profile := cached
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if profile == nil {
+			latest, err := profiles.Get(ctx, cached.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			profile = latest
+		}
+		if len(stateTransitions(profile.Labels, labels)) == 0 {
+			return nil
+		}
+
+		patch, err := labelsMergePatch(profile.ResourceVersion, labels)
+		if err != nil {
+			return err
+		}
+		updated, err := profiles.Patch(ctx, cached.Name, types.MergePatchType, patch,
+			metav1.PatchOptions{FieldManager: FIELD_MANAGER})
+		if err != nil {
+			profile = nil
+			return err
+		}
+		profile = updated
+		return nil
+	})
+	recordAPIUpdate("profile", err)
+
+	return profile, err
+}
+
+// patchNamespaceLabels applies the managed labels to a Namespace, like patchProfileLabels
+func (c *Controller) patchNamespaceLabels(ctx context.Context, cached *corev1.Namespace, labels map[string]string) (*corev1.Namespace, error) {
+	return c.patchNamespace(ctx, cached, func(namespace *corev1.Namespace) ([]byte, error) {
+		if len(stateTransitions(namespace.Labels, labels)) == 0 {
+			return nil, nil
+		}
+		return labelsMergePatch(namespace.ResourceVersion, labels)
+	})
+}
+
+// removeNamespaceLabels deletes the given labels from a Namespace. On a conflict only the
+// labels the Namespace still has are deleted.
+func (c *Controller) removeNamespaceLabels(ctx context.Context, cached *corev1.Namespace, labels []string) (*corev1.Namespace, error) {
+	return c.patchNamespace(ctx, cached, func(namespace *corev1.Namespace) ([]byte, error) {
+		remaining := []string{}
+		for _, label := range labels {
+			if _, ok := namespace.Labels[label]; ok {
+				remaining = append(remaining, label)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil, nil
+		}
+		return labelsRemovalMergePatch(namespace.ResourceVersion, remaining)
+	})
+}
+
+// patchNamespace applies the patch that build makes from a Namespace, starting from the cached
+// Namespace and reading it again after a conflict. build returns no patch when none is needed.
+func (c *Controller) patchNamespace(ctx context.Context, cached *corev1.Namespace, build func(*corev1.Namespace) ([]byte, error)) (*corev1.Namespace, error) {
+	namespaces := c.kubeclientset.CoreV1().Namespaces()
+	namespace := cached
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if namespace == nil {
+			latest, err := namespaces.Get(ctx, cached.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			namespace = latest
+		}
+		patch, err := build(namespace)
+		if err != nil || patch == nil {
+			return err
+		}
+
+		updated, err := namespaces.Patch(ctx, cached.Name, types.MergePatchType, patch,
+			metav1.PatchOptions{FieldManager: FIELD_MANAGER})
+		if err != nil {
+			namespace = nil
+			return err
+		}
+		namespace = updated
+		return nil
+	})
+	recordAPIUpdate("namespace", err)
+
+	return namespace, err
+}
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	kubeflowfake "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned/fake"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newConflictingClientset rejects the first namespace patch with a conflict after another writer
+// changed the namespace to the given labels, and records the patches it accepts
+func newConflictingClientset(otherLabels map[string]string, patches *[]map[string]interface{}) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", ResourceVersion: "1"}})
+	conflicted := false
+	clientset.PrependReactor("patch", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !conflicted {
+			conflicted = true
+			clientset.Tracker().Update(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"},
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", ResourceVersion: "2", Labels: otherLabels}}, "")
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "namespaces"}, "alice", nil)
+		}
+		patch := map[string]interface{}{}
+		json.Unmarshal(action.(k8stesting.PatchAction).GetPatch(), &patch)
+		*patches = append(*patches, patch)
+		return false, nil, nil
+	})
+	return clientset
+}
+
+func TestPatchRetriesConflictWithFreshResourceVersion(t *testing.T) {
+	c := newMockListerController(t)
+	patches := []map[string]interface{}{}
+	c.kubeclientset = newConflictingClientset(map[string]string{"owner": "alice"}, &patches)
+
+	cached := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", ResourceVersion: "1"}}
+	desired := desiredLabels([]bool{true, false, false, false, false})
+	namespace, err := c.patchNamespaceLabels(context.Background(), cached, desired)
+	if err != nil {
+		t.Fatalf("patchNamespaceLabels failed: %v", err)
+	}
+
+	if len(patches) != 1 {
+		t.Fatalf("Expected one patch after the conflict but got %v", patches)
+	}
+	if version := patches[0]["metadata"].(map[string]interface{})["resourceVersion"]; version != "2" {
+		t.Errorf("Expected the patch to carry the fresh resourceVersion but got %v", version)
+	}
+	if namespace.Labels["owner"] != "alice" || namespace.Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] != "true" {
+		t.Errorf("Expected the other writer's label to be kept next to the managed labels but got %v", namespace.Labels)
+	}
+}
+
+// No patch is sent again when the other writer already set the same labels
+func TestPatchSkippedWhenConflictAlreadyApplied(t *testing.T) {
+	c := newMockListerController(t)
+	patches := []map[string]interface{}{}
+	desired := desiredLabels([]bool{true, false, false, false, false})
+	c.kubeclientset = newConflictingClientset(desired, &patches)
+
+	cached := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", ResourceVersion: "1"}}
+	if _, err := c.patchNamespaceLabels(context.Background(), cached, desired); err != nil {
+		t.Fatalf("patchNamespaceLabels failed: %v", err)
+	}
+	if len(patches) != 0 {
+		t.Errorf("Expected no patch after the conflict but got %v", patches)
+	}
+
+	// Removal only deletes the labels that are still set
+	patches = []map[string]interface{}{}
+	c.kubeclientset = newConflictingClientset(map[string]string{NON_EMPLOYEE_USER: "true"}, &patches)
+	cached.Labels = desired
+	if _, err := c.removeNamespaceLabels(context.Background(), cached, []string{HAS_SAS_NOTEBOOK_FEATURE_LABEL, NON_EMPLOYEE_USER}); err != nil {
+		t.Fatalf("removeNamespaceLabels failed: %v", err)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("Expected one removal patch but got %v", patches)
+	}
+	removed := patches[0]["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if _, ok := removed[HAS_SAS_NOTEBOOK_FEATURE_LABEL]; ok || len(removed) != 1 {
+		t.Errorf("Expected only %s to be removed but got %v", NON_EMPLOYEE_USER, removed)
+	}
+}
+
+// A sync whose computed labels already match those of the profile and namespace sends no patch
+func TestSyncSkipsWritesWhenLabelsMatch(t *testing.T) {
+	c, kubeclientset := newMockSyncController(t)
+	kubeflowClientset := c.kubeflowClientset.(*kubeflowfake.Clientset)
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+
+	// Let the informers see the labels the first sync wrote
+	profile, err := kubeflowClientset.KubeflowV1().Profiles().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched profile: %v", err)
+	}
+	c.profileInformerLister.Informer().GetIndexer().Update(profile)
+	namespace, err := kubeclientset.CoreV1().Namespaces().Get(context.Background(), "alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get the patched namespace: %v", err)
+	}
+	c.namespaceInformerLister.Informer().GetIndexer().Update(namespace)
+
+	kubeclientset.ClearActions()
+	kubeflowClientset.ClearActions()
+	skippedProfiles := testutil.ToFloat64(skippedWrites.WithLabelValues("profile"))
+	skippedNamespaces := testutil.ToFloat64(skippedWrites.WithLabelValues("namespace"))
+
+	if err := c.syncHandler("alice"); err != nil {
+		t.Fatalf("syncHandler failed: %v", err)
+	}
+
+	if actions := writeActions(kubeclientset.Actions()); len(actions) != 0 {
+		t.Errorf("Expected no namespace writes but got %v", actions)
+	}
+	if actions := writeActions(kubeflowClientset.Actions()); len(actions) != 0 {
+		t.Errorf("Expected no profile writes but got %v", actions)
+	}
+	if skipped := testutil.ToFloat64(skippedWrites.WithLabelValues("profile")) - skippedProfiles; skipped != 1 {
+		t.Errorf("Expected 1 skipped profile write but got %v", skipped)
+	}
+	if skipped := testutil.ToFloat64(skippedWrites.WithLabelValues("namespace")) - skippedNamespaces; skipped != 1 {
+		t.Errorf("Expected 1 skipped namespace write but got %v", skipped)
+	}
+}
@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	kubeflow "github.com/StatCan/kubeflow-controller/pkg/generated/clientset/versioned"
+	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Report formats
+const (
+	REPORT_FORMAT_JSON     = "json"
+	REPORT_FORMAT_CSV      = "csv"
+	REPORT_FORMAT_MARKDOWN = "markdown"
+)
+
+// exceptionLists are the lists of the exceptions configuration, in the order they are reported
+var exceptionLists = []string{policy.SAS_NOTEBOOK_EXCEPTIONS, policy.CLOUD_MAIN_EXCEPTIONS}
+
+// Report describes the computed state of every Profile, for compliance reviews
+type Report struct {
+	GeneratedAt time.Time       `json:"generatedAt"`
+	Profiles    []ProfileReport `json:"profiles"`
+}
+
+// ProfileReport is the line of the Report for one Profile
+type ProfileReport struct {
+	Profile string            `json:"profile"`
+	Labels  map[string]string `json:"labels"`
+	// Risky is true when external users are mixed with a SAS notebook or internal storage
+	Risky               bool     `json:"risky"`
+	NonEmployeeSubjects []string `json:"nonEmployeeSubjects"`
+	// ExceptionsUsed lists the users who are only allowed because of an exceptions list,
+	// as "user (list)"
+	ExceptionsUsed []string `json:"exceptionsUsed"`
+	InternalPVCs   []string `json:"internalPVCs"`
+}
+
+// BuildReport evaluates every Profile against the objects of its namespace
+func BuildReport(profiles []*v1.Profile, objects func(namespace string) (NamespaceObjects, error), exceptions map[string][]string) (*Report, error) {
+	config := policy.Config{Exceptions: exceptions}
+
+	report := &Report{GeneratedAt: time.Now().UTC(), Profiles: []ProfileReport{}}
+	for _, profile := range profiles {
+		namespaceObjects, err := objects(profile.Name)
+		if err != nil {
+			return nil, err
+		}
+		report.Profiles = append(report.Profiles, profileReport(config, profile.Name, namespaceObjects))
+	}
+	sort.Slice(report.Profiles, func(i, j int) bool {
+		return report.Profiles[i].Profile < report.Profiles[j].Profile
+	})
+	return report, nil
+}
+
+// Report builds the Report from the informer caches, without calling the API server
+func (c *Controller) Report() (*Report, error) {
+	profiles, err := c.profileInformerLister.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return BuildReport(profiles, c.namespaceObjects, c.nonEmployeeExceptions)
+}
+
+func profileReport(config policy.Config, name string, objects NamespaceObjects) ProfileReport {
+	state, _ := policy.Evaluate(objects, config)
+	computed := state.Labels()
+	entry := ProfileReport{
+		Profile:             name,
+		Labels:              computed,
+		Risky:               riskyState(computed),
+		NonEmployeeSubjects: []string{},
+		ExceptionsUsed:      []string{},
+		InternalPVCs:        []string{},
+	}
+
+	seen := map[string]bool{}
+	for _, roleBinding := range objects.RoleBindings {
+		for _, subject := range roleBinding.Subjects {
+			if !policy.NonEmployee(subject) || seen[subject.Name] {
+				continue
+			}
+			seen[subject.Name] = true
+			entry.NonEmployeeSubjects = append(entry.NonEmployeeSubjects, subject.Name)
+			if lists := exceptionListsOf(config, subject); len(lists) > 0 {
+				entry.ExceptionsUsed = append(entry.ExceptionsUsed, fmt.Sprintf("%s (%s)", subject.Name, strings.Join(lists, ", ")))
+			}
+		}
+	}
+	sort.Strings(entry.NonEmployeeSubjects)
+	sort.Strings(entry.ExceptionsUsed)
+
+	for _, pvc := range objects.PersistentVolumeClaims {
+		if policy.InternalPVC(pvc.Name) {
+			entry.InternalPVCs = append(entry.InternalPVCs, pvc.Name)
+		}
+	}
+	sort.Strings(entry.InternalPVCs)
+
+	return entry
+}
+
+// exceptionListsOf lists the exceptions lists that contain a subject
+func exceptionListsOf(config policy.Config, subject rbacv1.Subject) []string {
+	lists := []string{}
+	for _, list := range exceptionLists {
+		if config.Excepted(list, subject.Name) {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// Write writes the Report in one of the REPORT_FORMAT_* formats
+func (r *Report) Write(out io.Writer, format string) error {
+	switch format {
+	case REPORT_FORMAT_JSON:
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case REPORT_FORMAT_CSV:
+		return r.writeCSV(out)
+	case REPORT_FORMAT_MARKDOWN:
+		return r.writeMarkdown(out)
+	default:
+		return fmt.Errorf("unknown report format %q, expected %s, %s or %s", format, REPORT_FORMAT_JSON, REPORT_FORMAT_CSV, REPORT_FORMAT_MARKDOWN)
+	}
+}
+
+// reportColumns are the CSV and Markdown columns, which follow the JSON fields
+func reportColumns() []string {
+	columns := []string{"profile", "risky"}
+	columns = append(columns, stateLabels...)
+	return append(columns, "nonEmployeeSubjects", "exceptionsUsed", "internalPVCs")
+}
+
+func (p ProfileReport) row(separator string) []string {
+	row := []string{p.Profile, fmt.Sprintf("%t", p.Risky)}
+	for _, label := range stateLabels {
+		row = append(row, p.Labels[label])
+	}
+	return append(row,
+		strings.Join(p.NonEmployeeSubjects, separator),
+		strings.Join(p.ExceptionsUsed, separator),
+		strings.Join(p.InternalPVCs, separator))
+}
+
+func (r *Report) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(reportColumns()); err != nil {
+		return err
+	}
+	for _, profile := range r.Profiles {
+		if err := w.Write(profile.row(";")); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func (r *Report) writeMarkdown(out io.Writer) error {
+	columns := reportColumns()
+	for i, column := range columns {
+		if i >= 2 && i < 2+len(stateLabels) {
+			columns[i] = column[strings.Index(column, "/")+1:]
+		}
+	}
+
+	fmt.Fprintf(out, "# Profile state report\n\nGenerated at %s.\n\n", r.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(out, "| %s |\n", strings.Join(columns, " | "))
+	fmt.Fprintf(out, "|%s\n", strings.Repeat(" --- |", len(columns)))
+	for _, profile := range r.Profiles {
+		row := profile.row("<br>")
+		for i, cell := range row {
+			row[i] = strings.ReplaceAll(cell, "|", "\\|")
+		}
+		if _, err := fmt.Fprintf(out, "| %s |\n", strings.Join(row, " | ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportContentTypes maps the report formats onto their HTTP content types
+var reportContentTypes = map[string]string{
+	REPORT_FORMAT_JSON:     "application/json",
+	REPORT_FORMAT_CSV:      "text/csv",
+	REPORT_FORMAT_MARKDOWN: "text/markdown",
+}
+
+// ServeReport serves the Report, in the format given by the format query parameter (json by default)
+func (c *Controller) ServeReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = REPORT_FORMAT_JSON
+	}
+	contentType, ok := reportContentTypes[format]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("unknown report format %q", format))
+		return
+	}
+	if !c.hasSynced() {
+		writeAPIError(w, http.StatusServiceUnavailable, "informer caches are not synced yet")
+		return
+	}
+
+	report, err := c.Report()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, fmt.Sprintf("failed to build report: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := report.Write(w, format); err != nil {
+		log.Errorf("failed to write report: %v", err)
+	}
+}
+
+// FetchManifests lists the Profiles and the objects of every namespace with one request per
+// resource type, for commands that run without informer caches
+func FetchManifests(ctx context.Context, client kubernetes.Interface, kubeflowClient kubeflow.Interface) (*Manifests, error) {
+	manifests := &Manifests{Objects: map[string]*NamespaceObjects{}}
+
+	profiles, err := kubeflowClient.KubeflowV1().Profiles().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range profiles.Items {
+		manifests.add(&profiles.Items[i])
+	}
+
+	objects, err := FetchNamespaceObjects(ctx, client, metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range objects.Pods {
+		manifests.add(pod)
+	}
+	for _, roleBinding := range objects.RoleBindings {
+		manifests.add(roleBinding)
+	}
+	for _, pvc := range objects.PersistentVolumeClaims {
+		manifests.add(pvc)
+	}
+
+	return manifests, nil
+}
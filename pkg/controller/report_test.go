@@ -0,0 +1,114 @@
+/*
+These tests build the compliance report from the informer caches of a mock controller and serve it in every format.
+*/
+
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/StatCan/kubeflow-controller/pkg/apis/kubeflowcontroller/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Build a mock controller with a Profile for every namespace of newMockListerController, and a
+// namespace jane whose only user is in both exceptions lists
+func newMockReportController(t *testing.T) *Controller {
+	return newMockListerController(t,
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "alice"}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "bob"}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "jane"}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "sam"}},
+		&v1.Profile{ObjectMeta: metav1.ObjectMeta{Name: "test"}},
+		&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "user-jane-external", Namespace: "jane"},
+			Subjects:   []rbacv1.Subject{{Kind: "User", Name: "jane.doe@notanemployee.ca"}},
+		},
+	)
+}
+
+func TestReportFromCaches(t *testing.T) {
+	report, err := newMockReportController(t).Report()
+	if err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+
+	profiles := map[string]ProfileReport{}
+	for _, profile := range report.Profiles {
+		profiles[profile.Profile] = profile
+	}
+	if len(profiles) != 5 {
+		t.Fatalf("Expected a line for each of the 5 profiles but got %d", len(profiles))
+	}
+
+	if profiles["alice"].Labels[HAS_SAS_NOTEBOOK_FEATURE_LABEL] != "true" || profiles["alice"].Risky {
+		t.Errorf("Expected alice to have a SAS notebook without being risky, got %+v", profiles["alice"])
+	}
+	if subjects := strings.Join(profiles["sam"].NonEmployeeSubjects, ","); subjects != "test@external.ca" {
+		t.Errorf("Expected test@external.ca as the non-employee of sam but got %q", subjects)
+	}
+	if pvcs := strings.Join(profiles["test"].InternalPVCs, ","); pvcs != "fdi-test-iunc-unclassified" {
+		t.Errorf("Expected the internal PVC of test but got %q", pvcs)
+	}
+	if used := strings.Join(profiles["jane"].ExceptionsUsed, ","); used != "jane.doe@notanemployee.ca (sasNotebookExceptions, cloudMainExceptions)" {
+		t.Errorf("Expected jane.doe@notanemployee.ca to use both exceptions lists but got %q", used)
+	}
+	if len(profiles["bob"].NonEmployeeSubjects) != 0 || len(profiles["bob"].ExceptionsUsed) != 0 {
+		t.Errorf("Expected bob to have employees only, got %+v", profiles["bob"])
+	}
+}
+
+func serveReport(t *testing.T, c *Controller, query string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	c.ServeReport(recorder, httptest.NewRequest(http.MethodGet, "/report"+query, nil))
+	return recorder
+}
+
+func TestServeReportAsCSV(t *testing.T) {
+	response := serveReport(t, newMockReportController(t), "?format=csv")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("Expected a CSV report but got %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	rows, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse the CSV report: %v", err)
+	}
+	if len(rows) != 6 || strings.Join(rows[0], ",") != strings.Join(reportColumns(), ",") {
+		t.Fatalf("Expected a header and 5 rows but got %v", rows)
+	}
+}
+
+func TestServeReportAsMarkdown(t *testing.T) {
+	response := serveReport(t, newMockReportController(t), "?format=markdown")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected a Markdown report but got %d", response.Code)
+	}
+	if body := response.Body.String(); !strings.Contains(body, "| sam | false |") || !strings.Contains(body, "| has-sas-notebook-feature |") {
+		t.Fatalf("Expected a Markdown table with a row for sam but got:\n%s", body)
+	}
+}
+
+func TestServeReportRejectsUnknownFormat(t *testing.T) {
+	response := serveReport(t, newMockReportController(t), "?format=xml")
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown format but got %d", response.Code)
+	}
+	body := map[string]string{}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil || body["error"] != `unknown report format "xml"` {
+		t.Errorf("Expected a JSON error naming the format but got %q", response.Body.String())
+	}
+}
+
+func TestServeReportRejectsOtherMethods(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	newMockReportController(t).ServeReport(recorder, httptest.NewRequest(http.MethodPost, "/report", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("Expected 405 for POST but got %d", recorder.Code)
+	}
+}
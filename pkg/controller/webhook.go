@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// WebhookOptions configures the admission webhooks served by the controller
+type WebhookOptions struct {
+	// ServiceAccount is the username of the controller's own ServiceAccount, for example
+	// system:serviceaccount:statcan-system:profile-state-controller
+	ServiceAccount string
+
+	// AdminGroups lists the groups whose members may also change the state labels
+	AdminGroups []string
+
+	// SasPodWarnOnly admits SAS pods that would be denied, returning a warning instead
+	SasPodWarnOnly bool
+
+	// InternalPVCServiceAccounts lists the platform ServiceAccounts that may create internal
+	// storage PVCs in any namespace
+	InternalPVCServiceAccounts []string
+
+	// SensitiveNamespaceSelectors select the namespaces whose resources the authorization
+	// webhook denies to non-employees, for example those with internal blob storage
+	SensitiveNamespaceSelectors []labels.Selector
+
+	// SensitiveNamespaceExceptionList names the list of the exceptions configuration whose
+	// users the authorization webhook treats as employees
+	SensitiveNamespaceExceptionList string
+
+	// AuthorizationFailClosed denies a non-employee's request when the authorization webhook
+	// cannot check it, instead of leaving the decision to the next authorizer
+	AuthorizationFailClosed bool
+}
+
+// Webhook serves the validating admission webhooks
+type Webhook struct {
+	controller *Controller
+	options    WebhookOptions
+}
+
+// NewWebhook creates the admission webhooks for a controller
+func NewWebhook(controller *Controller, options WebhookOptions) *Webhook {
+	return &Webhook{
+		controller: controller,
+		options:    options,
+	}
+}
+
+// Handler returns the HTTP handler for every webhook path, including the authorization webhook
+func (wh *Webhook) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate-state-labels", wh.serveAdmission(wh.validateStateLabels))
+	mux.HandleFunc("/validate-sas-pods", wh.serveAdmission(wh.validateSasPods))
+	mux.HandleFunc("/validate-rolebindings", wh.serveAdmission(wh.validateRoleBindings))
+	mux.HandleFunc("/validate-internal-pvcs", wh.serveAdmission(wh.validateInternalPVCs))
+	mux.HandleFunc("/authorize", wh.serveAuthorization)
+	return mux
+}
+
+// serveAdmission decodes an AdmissionReview, passes its request to review and writes back the response
+func (wh *Webhook) serveAdmission(review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		admissionReview := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, &admissionReview); err != nil || admissionReview.Request == nil {
+			http.Error(w, "expected an AdmissionReview with a request", http.StatusBadRequest)
+			return
+		}
+
+		response := review(admissionReview.Request)
+		response.UID = admissionReview.Request.UID
+		admissionReview.Response = response
+		admissionReview.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(admissionReview); err != nil {
+			log.Errorf("failed to write admission response: %v", err)
+		}
+	}
+}
+
+func allowed() *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func denied(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: message,
+		},
+	}
+}
+
+// privilegedUser returns true for the controller itself and for members of an admin group
+func (wh *Webhook) privilegedUser(request *admissionv1.AdmissionRequest) bool {
+	if wh.options.ServiceAccount != "" && request.UserInfo.Username == wh.options.ServiceAccount {
+		return true
+	}
+	for _, group := range request.UserInfo.Groups {
+		for _, adminGroup := range wh.options.AdminGroups {
+			if group == adminGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// objectLabels reads the labels of any object in an admission request
+func objectLabels(raw []byte) (map[string]string, error) {
+	if len(raw) == 0 {
+		return map[string]string{}, nil
+	}
+	object := metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	return object.Labels, nil
+}
+
+// touchedStateLabels lists the managed labels whose presence or value differs between two label sets
+func touchedStateLabels(oldLabels map[string]string, newLabels map[string]string) []string {
+	touched := []string{}
+	for _, label := range stateLabels {
+		oldValue, oldOk := oldLabels[label]
+		newValue, newOk := newLabels[label]
+		if oldOk != newOk || oldValue != newValue {
+			touched = append(touched, label)
+		}
+	}
+	sort.Strings(touched)
+	return touched
+}
+
+// validateStateLabels rejects changes to the managed labels of Namespaces and Profiles
+// unless they come from the controller or an admin.
+func (wh *Webhook) validateStateLabels(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if request.Operation != admissionv1.Create && request.Operation != admissionv1.Update {
+		return allowed()
+	}
+	if request.Kind.Kind != "Namespace" && request.Kind.Kind != "Profile" {
+		return allowed()
+	}
+	if wh.privilegedUser(request) {
+		return allowed()
+	}
+
+	newLabels, err := objectLabels(request.Object.Raw)
+	if err != nil {
+		return denied(fmt.Sprintf("failed to decode %s: %v", request.Kind.Kind, err))
+	}
+	oldLabels, err := objectLabels(request.OldObject.Raw)
+	if err != nil {
+		return denied(fmt.Sprintf("failed to decode %s: %v", request.Kind.Kind, err))
+	}
+
+	touched := touchedStateLabels(oldLabels, newLabels)
+	if len(touched) == 0 {
+		return allowed()
+	}
+
+	log.Infof("denied %s of %s %s by %s: state labels %v are managed by the profile state controller",
+		strings.ToLower(string(request.Operation)), request.Kind.Kind, request.Name, request.UserInfo.Username, touched)
+	return denied(fmt.Sprintf("the labels %s are managed by the profile state controller and cannot be changed by %s",
+		strings.Join(touched, ", "), request.UserInfo.Username))
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Failure policies of the authorization webhook, applied when it cannot decide
+const (
+	AUTHORIZATION_FAILURE_POLICY_OPEN   = "open"
+	AUTHORIZATION_FAILURE_POLICY_CLOSED = "closed"
+)
+
+// ParseAuthorizationFailurePolicy returns whether the authorization webhook fails closed,
+// accepting nothing but the AUTHORIZATION_FAILURE_POLICY_* values
+func ParseAuthorizationFailurePolicy(policy string) (bool, error) {
+	switch policy {
+	case AUTHORIZATION_FAILURE_POLICY_OPEN:
+		return false, nil
+	case AUTHORIZATION_FAILURE_POLICY_CLOSED:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown failure policy %q, expected %s or %s", policy, AUTHORIZATION_FAILURE_POLICY_OPEN, AUTHORIZATION_FAILURE_POLICY_CLOSED)
+	}
+}
+
+// ParseSensitiveNamespaceSelectors parses a semicolon-separated list of label selectors
+func ParseSensitiveNamespaceSelectors(value string) ([]labels.Selector, error) {
+	selectors := []labels.Selector{}
+	for _, query := range strings.Split(value, ";") {
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+		selector, err := labels.Parse(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector %q: %v", query, err)
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// authorize answers a SubjectAccessReview from the API server. Non-employees are denied access to
+// the resources of a namespace whose labels match one of the sensitive namespace selectors. Every
+// other request gets no opinion, so that the next authorizer, usually RBAC, decides.
+func (wh *Webhook) authorize(review *authorizationv1.SubjectAccessReview) authorizationv1.SubjectAccessReviewStatus {
+	attributes := review.Spec.ResourceAttributes
+	if attributes == nil {
+		return noOpinion()
+	}
+	namespace := attributes.Namespace
+	if namespace == "" && attributes.Group == "" && attributes.Resource == "namespaces" {
+		namespace = attributes.Name
+	}
+	if namespace == "" {
+		return noOpinion()
+	}
+
+	user := rbacv1.Subject{Kind: "User", Name: review.Spec.User}
+	if !policy.NonEmployee(user) || wh.authorizationException(user.Name) {
+		return noOpinion()
+	}
+
+	if !wh.controller.namespaceSynced() {
+		return wh.authorizationFailure(review, "the profile state controller has not synced Namespaces yet")
+	}
+	ns, err := wh.controller.namespaceInformerLister.Lister().Get(namespace)
+	if errors.IsNotFound(err) {
+		return noOpinion()
+	}
+	if err != nil {
+		return wh.authorizationFailure(review, fmt.Sprintf("failed to get Namespace %s: %v", namespace, err))
+	}
+
+	for _, selector := range wh.options.SensitiveNamespaceSelectors {
+		if selector.Matches(labels.Set(ns.Labels)) {
+			reason := fmt.Sprintf("%s is not an employee (%s) and namespace %s is sensitive (%s)",
+				user.Name, policy.NonEmployeeReason(user.Name), namespace, selector.String())
+			log.Infof("denied %s of %s in %s to %s: %s", attributes.Verb, attributes.Resource, namespace, user.Name, reason)
+			return authorizationv1.SubjectAccessReviewStatus{Denied: true, Reason: reason}
+		}
+	}
+	return noOpinion()
+}
+
+// authorizationException returns whether a user is in the exceptions list of the authorization webhook
+func (wh *Webhook) authorizationException(name string) bool {
+	if wh.options.SensitiveNamespaceExceptionList == "" {
+		return false
+	}
+	return wh.controller.policyConfig().Excepted(wh.options.SensitiveNamespaceExceptionList, name)
+}
+
+// authorizationFailure applies the failure policy when a non-employee's request cannot be checked
+func (wh *Webhook) authorizationFailure(review *authorizationv1.SubjectAccessReview, message string) authorizationv1.SubjectAccessReviewStatus {
+	if wh.options.AuthorizationFailClosed {
+		log.Warnf("denied request of %s, failing closed: %s", review.Spec.User, message)
+		return authorizationv1.SubjectAccessReviewStatus{Denied: true, Reason: message}
+	}
+	log.Warnf("no opinion on request of %s, failing open: %s", review.Spec.User, message)
+	return authorizationv1.SubjectAccessReviewStatus{EvaluationError: message}
+}
+
+func noOpinion() authorizationv1.SubjectAccessReviewStatus {
+	return authorizationv1.SubjectAccessReviewStatus{Allowed: false, Denied: false}
+}
+
+// serveAuthorization decodes a SubjectAccessReview, answers it and writes it back with its status
+func (wh *Webhook) serveAuthorization(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review := authorizationv1.SubjectAccessReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Kind != "SubjectAccessReview" {
+		http.Error(w, "expected a SubjectAccessReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Status = wh.authorize(&review)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Errorf("failed to write authorization response: %v", err)
+	}
+}
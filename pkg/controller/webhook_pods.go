@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// validateSasPods rejects SAS pods in namespaces whose RoleBindings contain a user who is not
+// permitted to use SAS, using the same logic as the exists-non-sas-notebook-user label.
+func (wh *Webhook) validateSasPods(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if request.Operation != admissionv1.Create || request.Kind.Kind != "Pod" {
+		return allowed()
+	}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		return denied(fmt.Sprintf("failed to decode Pod: %v", err))
+	}
+	if !sasImage(pod) {
+		return allowed()
+	}
+
+	if !wh.controller.roleBindingSynced() {
+		return wh.sasPodResponse("the profile state controller has not synced RoleBindings yet, retry shortly")
+	}
+	roleBindings, err := wh.controller.roleBindingLister.RoleBindings(request.Namespace).List(labels.Everything())
+	if err != nil {
+		return wh.sasPodResponse(fmt.Sprintf("failed to list RoleBindings in %s: %v", request.Namespace, err))
+	}
+	if !wh.controller.existsNonSasUser(roleBindings) {
+		return allowed()
+	}
+
+	message := fmt.Sprintf("SAS pods cannot run in namespace %s because it contains users who are not permitted to use SAS: %s",
+		request.Namespace, strings.Join(wh.controller.nonSasUsers(roleBindings), ", "))
+	log.Infof("SAS pod %s in namespace %s: %s", podName(pod), request.Namespace, message)
+	return wh.sasPodResponse(message)
+}
+
+// sasPodResponse denies the pod, or only warns when the webhook is being rolled out
+func (wh *Webhook) sasPodResponse(message string) *admissionv1.AdmissionResponse {
+	if wh.options.SasPodWarnOnly {
+		response := allowed()
+		response.Warnings = []string{message}
+		return response
+	}
+	return denied(message)
+}
+
+// podName returns the name of a pod, or its generateName prefix before it is assigned
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
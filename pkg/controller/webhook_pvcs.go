@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// validateInternalPVCs rejects internal FDI bucket PVCs in namespaces whose RoleBindings contain a
+// non-employee, covering PVCs that are created directly rather than by the blob CSI controller.
+func (wh *Webhook) validateInternalPVCs(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if request.Operation != admissionv1.Create || request.Kind.Kind != "PersistentVolumeClaim" {
+		return allowed()
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(request.Object.Raw, pvc); err != nil {
+		return denied(fmt.Sprintf("failed to decode PersistentVolumeClaim: %v", err))
+	}
+	if !wh.controller.internalPVC(pvc.Name) {
+		return allowed()
+	}
+	for _, serviceAccount := range wh.options.InternalPVCServiceAccounts {
+		if request.UserInfo.Username == serviceAccount {
+			return allowed()
+		}
+	}
+
+	if !wh.controller.roleBindingSynced() {
+		return denied("the profile state controller has not synced RoleBindings yet, retry shortly")
+	}
+	roleBindings, err := wh.controller.roleBindingLister.RoleBindings(request.Namespace).List(labels.Everything())
+	if err != nil {
+		return denied(fmt.Sprintf("failed to list RoleBindings in %s: %v", request.Namespace, err))
+	}
+	if !wh.controller.existsNonEmployee(roleBindings) {
+		return allowed()
+	}
+
+	subjects := []rbacv1.Subject{}
+	for _, roleBinding := range roleBindings {
+		subjects = append(subjects, roleBinding.Subjects...)
+	}
+	message := fmt.Sprintf("internal storage PersistentVolumeClaim %s cannot be created in namespace %s because it contains non-employees: %s",
+		pvc.Name, request.Namespace, strings.Join(subjectNames(subjects, wh.controller.roleBindingContainsNonEmployee), ", "))
+	log.Infof("denied PersistentVolumeClaim %s/%s requested by %s: %s", request.Namespace, pvc.Name, request.UserInfo.Username, message)
+	return denied(message)
+}
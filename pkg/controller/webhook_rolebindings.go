@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// addedSubjects returns the subjects of a RoleBinding that were not bound by its previous version
+func addedSubjects(newRoleBinding *rbacv1.RoleBinding, oldRoleBinding *rbacv1.RoleBinding) []rbacv1.Subject {
+	existing := map[rbacv1.Subject]bool{}
+	if oldRoleBinding != nil {
+		for _, subject := range oldRoleBinding.Subjects {
+			existing[subject] = true
+		}
+	}
+	added := []rbacv1.Subject{}
+	for _, subject := range newRoleBinding.Subjects {
+		if !existing[subject] {
+			added = append(added, subject)
+		}
+	}
+	return added
+}
+
+// subjectNames lists the names of the subjects accepted by matches
+func subjectNames(subjects []rbacv1.Subject, matches func(*rbacv1.RoleBinding) bool) []string {
+	names := []string{}
+	for _, subject := range subjects {
+		if matches(&rbacv1.RoleBinding{Subjects: []rbacv1.Subject{subject}}) {
+			names = append(names, subject.Name)
+		}
+	}
+	return names
+}
+
+// validateRoleBindings rejects a RoleBinding that would add a non-employee to a namespace that
+// already runs a SAS notebook or mounts internal FDI storage.
+func (wh *Webhook) validateRoleBindings(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if request.Operation != admissionv1.Create && request.Operation != admissionv1.Update {
+		return allowed()
+	}
+	if request.Kind.Kind != "RoleBinding" {
+		return allowed()
+	}
+
+	newRoleBinding := &rbacv1.RoleBinding{}
+	if err := json.Unmarshal(request.Object.Raw, newRoleBinding); err != nil {
+		return denied(fmt.Sprintf("failed to decode RoleBinding: %v", err))
+	}
+	var oldRoleBinding *rbacv1.RoleBinding
+	if len(request.OldObject.Raw) > 0 {
+		oldRoleBinding = &rbacv1.RoleBinding{}
+		if err := json.Unmarshal(request.OldObject.Raw, oldRoleBinding); err != nil {
+			return denied(fmt.Sprintf("failed to decode RoleBinding: %v", err))
+		}
+	}
+
+	// Simulate the binding with only the subjects it adds to the namespace
+	added := &rbacv1.RoleBinding{Subjects: addedSubjects(newRoleBinding, oldRoleBinding)}
+	addsNonSasUser := wh.controller.rolebindingContainsNonSasUser(added)
+	addsNonEmployee := wh.controller.roleBindingContainsNonEmployee(added)
+	if !addsNonSasUser && !addsNonEmployee {
+		return allowed()
+	}
+
+	if !wh.controller.podSynched() || !wh.controller.persistentVolumeClaimSynced() {
+		return denied("the profile state controller has not synced Pods and PersistentVolumeClaims yet, retry shortly")
+	}
+	pods, err := wh.controller.podLister.Pods(request.Namespace).List(labels.Everything())
+	if err != nil {
+		return denied(fmt.Sprintf("failed to list Pods in %s: %v", request.Namespace, err))
+	}
+	pvcs, err := wh.controller.persistentVolumeClaimlister.PersistentVolumeClaims(request.Namespace).List(labels.Everything())
+	if err != nil {
+		return denied(fmt.Sprintf("failed to list PersistentVolumeClaims in %s: %v", request.Namespace, err))
+	}
+
+	reasons := []string{}
+	if addsNonSasUser && wh.controller.hasSasNotebookFeature(pods) {
+		reasons = append(reasons, fmt.Sprintf("namespace %s has a SAS notebook (%s) and %s not permitted to use SAS",
+			request.Namespace, HAS_SAS_NOTEBOOK_FEATURE_LABEL,
+			describeSubjects(subjectNames(added.Subjects, wh.controller.rolebindingContainsNonSasUser))))
+	}
+	if addsNonEmployee && wh.controller.existsInternalCommonStorage(pvcs) {
+		reasons = append(reasons, fmt.Sprintf("namespace %s mounts internal FDI storage (%s) and %s not an employee",
+			request.Namespace, EXISTS_INTERNAL_BLOB_STORAGE,
+			describeSubjects(subjectNames(added.Subjects, wh.controller.roleBindingContainsNonEmployee))))
+	}
+	if len(reasons) == 0 {
+		return allowed()
+	}
+
+	message := fmt.Sprintf("RoleBinding %s cannot be applied: %s", newRoleBinding.Name, strings.Join(reasons, "; "))
+	log.Infof("denied RoleBinding %s/%s (adds non-SAS user=%t, non-employee=%t): %s",
+		request.Namespace, newRoleBinding.Name, addsNonSasUser, addsNonEmployee, message)
+	return denied(message)
+}
+
+// describeSubjects joins subject names into "a is" or "a, b are"
+func describeSubjects(names []string) string {
+	if len(names) == 1 {
+		return names[0] + " is"
+	}
+	return strings.Join(names, ", ") + " are"
+}
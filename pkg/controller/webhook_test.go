@@ -0,0 +1,337 @@
+/*
+These tests replay AdmissionReview fixtures from the tests/webhook folder against the admission webhooks.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//        _   _ _
+//  _   _| |_(_) |___
+// | | | | __| | / __|
+// | |_| | |_| | \__ \
+// \__,_|\__|_|_|___/
+
+var mockWebhookOptions = WebhookOptions{
+	ServiceAccount: "system:serviceaccount:statcan-system:profile-state-controller",
+	AdminGroups:    []string{"aaw-admins"},
+	InternalPVCServiceAccounts: []string{
+		"system:serviceaccount:blob-csi-system:blob-csi-injector",
+	},
+}
+
+// Load an AdmissionReview from a JSON fixture
+func getAdmissionReview(t *testing.T, filePath string) *admissionv1.AdmissionReview {
+	body, err := ioutil.ReadFile(filepath.Join(TEST_DIRECTORY, "webhook", filePath))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", filePath, err)
+	}
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		t.Fatalf("Failed to decode fixture %s: %v", filePath, err)
+	}
+	return review
+}
+
+// Send an AdmissionReview fixture through the webhook HTTP handler and return the response
+func reviewFixture(t *testing.T, path string, filePath string) *admissionv1.AdmissionResponse {
+	return reviewFixtureWith(t, NewWebhook(newMockListerController(t), mockWebhookOptions), path, filePath)
+}
+
+func reviewFixtureWith(t *testing.T, webhook *Webhook, path string, filePath string) *admissionv1.AdmissionResponse {
+	body, err := ioutil.ReadFile(filepath.Join(TEST_DIRECTORY, "webhook", filePath))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", filePath, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	webhook.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 from %s but got %d", path, recorder.Code)
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), review); err != nil {
+		t.Fatalf("Failed to decode response for %s: %v", filePath, err)
+	}
+	if review.Response == nil {
+		t.Fatalf("Expected a response for %s", filePath)
+	}
+	if review.Response.UID != getAdmissionReview(t, filePath).Request.UID {
+		t.Fatalf("Expected the response UID to match the request UID for %s", filePath)
+	}
+	return review.Response
+}
+
+//  _            _
+// | |_ ___  ___| |_ ___
+// | __/ _ \/ __| __/ __|
+// | ||  __/\__ \ |_\__ \
+//  \__\___||___/\__|___/
+
+// A user removing a state label from their namespace is denied
+func TestUserRemovingStateLabelIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-state-labels", "state_labels/1_user_removes_namespace_label.json")
+	if response.Allowed {
+		t.Fatalf("Expected removing state.aaw.statcan.gc.ca/non-employee-users by a user to be denied.")
+	}
+}
+
+// The controller's own ServiceAccount may change the state labels
+func TestControllerChangingStateLabelIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-state-labels", "state_labels/2_controller_updates_namespace_label.json")
+	if !response.Allowed {
+		t.Fatalf("Expected the controller's ServiceAccount to be allowed to change state labels: %v", response.Result)
+	}
+}
+
+// Members of an admin group may change the state labels
+func TestAdminChangingStateLabelIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-state-labels", "state_labels/3_admin_updates_profile_label.json")
+	if !response.Allowed {
+		t.Fatalf("Expected a member of aaw-admins to be allowed to change state labels: %v", response.Result)
+	}
+}
+
+// Changes to labels that are not managed by the controller are allowed
+func TestUserChangingUnrelatedLabelIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-state-labels", "state_labels/4_user_updates_unrelated_label.json")
+	if !response.Allowed {
+		t.Fatalf("Expected a change to an unmanaged label to be allowed: %v", response.Result)
+	}
+}
+
+// A user creating a profile that already carries a state label is denied
+func TestUserCreatingProfileWithStateLabelIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-state-labels", "state_labels/5_user_creates_profile_with_label.json")
+	if response.Allowed {
+		t.Fatalf("Expected creating a Profile with state.aaw.statcan.gc.ca/non-employee-users by a user to be denied.")
+	}
+}
+
+// A SAS pod in a namespace with a user who may not use SAS is denied, naming the user
+func TestSasPodWithNonSasUserIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-sas-pods", "sas_pods/1_sas_pod_with_non_sas_user.json")
+	if response.Allowed {
+		t.Fatalf("Expected a SAS pod to be denied in a namespace with a non-SAS user.")
+	}
+	if !strings.Contains(response.Result.Message, "test@external.ca") {
+		t.Fatalf("Expected the denial to name test@external.ca but got: %s", response.Result.Message)
+	}
+}
+
+// A SAS pod in a namespace with only employees is allowed
+func TestSasPodWithEmployeesOnlyIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-sas-pods", "sas_pods/2_sas_pod_with_employees_only.json")
+	if !response.Allowed {
+		t.Fatalf("Expected a SAS pod to be allowed in a namespace with only employees: %v", response.Result)
+	}
+}
+
+// A pod without a SAS image is allowed whoever is in the namespace
+func TestNonSasPodWithNonSasUserIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-sas-pods", "sas_pods/3_non_sas_pod_with_non_sas_user.json")
+	if !response.Allowed {
+		t.Fatalf("Expected a non-SAS pod to be allowed: %v", response.Result)
+	}
+}
+
+// In warn-only mode a SAS pod that would be denied is allowed with a warning
+func TestSasPodWithNonSasUserWarnOnly(t *testing.T) {
+	options := mockWebhookOptions
+	options.SasPodWarnOnly = true
+	webhook := NewWebhook(newMockListerController(t), options)
+
+	response := reviewFixtureWith(t, webhook, "/validate-sas-pods", "sas_pods/1_sas_pod_with_non_sas_user.json")
+	if !response.Allowed || len(response.Warnings) == 0 {
+		t.Fatalf("Expected a SAS pod to be allowed with a warning in warn-only mode.")
+	}
+}
+
+// A non-employee added to a namespace with a SAS notebook is denied by the SAS rule
+func TestNonEmployeeIntoSasNamespaceIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-rolebindings", "rolebindings/1_non_employee_into_sas_namespace.json")
+	if response.Allowed {
+		t.Fatalf("Expected adding test@external.ca to a namespace with a SAS notebook to be denied.")
+	}
+	if !strings.Contains(response.Result.Message, HAS_SAS_NOTEBOOK_FEATURE_LABEL) {
+		t.Fatalf("Expected the denial to explain the SAS rule but got: %s", response.Result.Message)
+	}
+}
+
+// A non-employee with a SAS exception may join a namespace with a SAS notebook
+func TestSasExceptedUserIntoSasNamespaceIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-rolebindings", "rolebindings/2_sas_excepted_user_into_sas_namespace.json")
+	if !response.Allowed {
+		t.Fatalf("Expected adding alice.smith@external.ca, who has a SAS exception, to be allowed: %v", response.Result)
+	}
+}
+
+// A non-employee added to a namespace with internal storage is denied by the storage rule, even with exceptions
+func TestNonEmployeeIntoInternalStorageNamespaceIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-rolebindings", "rolebindings/3_non_employee_into_internal_storage_namespace.json")
+	if response.Allowed {
+		t.Fatalf("Expected adding alice.smith@external.ca to a namespace with internal storage to be denied.")
+	}
+	if !strings.Contains(response.Result.Message, EXISTS_INTERNAL_BLOB_STORAGE) {
+		t.Fatalf("Expected the denial to explain the internal storage rule but got: %s", response.Result.Message)
+	}
+}
+
+func TestEmployeeIntoSasNamespaceIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-rolebindings", "rolebindings/4_employee_into_sas_namespace.json")
+	if !response.Allowed {
+		t.Fatalf("Expected adding an employee to be allowed: %v", response.Result)
+	}
+}
+
+// Updating a RoleBinding without adding subjects is allowed, as it does not change the namespace's users
+func TestRoleBindingUpdateWithUnchangedSubjectsIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-rolebindings", "rolebindings/5_update_with_unchanged_subjects.json")
+	if !response.Allowed {
+		t.Fatalf("Expected an update that adds no subjects to be allowed: %v", response.Result)
+	}
+}
+
+// An internal bucket PVC in a namespace with a non-employee is denied
+func TestInternalPVCWithNonEmployeeIsDenied(t *testing.T) {
+	response := reviewFixture(t, "/validate-internal-pvcs", "internal_pvcs/1_internal_pvc_with_non_employee.json")
+	if response.Allowed {
+		t.Fatalf("Expected an internal PVC to be denied in a namespace with a non-employee.")
+	}
+	if !strings.Contains(response.Result.Message, "test@external.ca") {
+		t.Fatalf("Expected the denial to name test@external.ca but got: %s", response.Result.Message)
+	}
+}
+
+// Platform ServiceAccounts in the exception list may create internal bucket PVCs
+func TestInternalPVCByPlatformServiceAccountIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-internal-pvcs", "internal_pvcs/2_internal_pvc_by_platform_service_account.json")
+	if !response.Allowed {
+		t.Fatalf("Expected an internal PVC created by an excepted ServiceAccount to be allowed: %v", response.Result)
+	}
+}
+
+func TestInternalPVCWithEmployeesOnlyIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-internal-pvcs", "internal_pvcs/3_internal_pvc_with_employees_only.json")
+	if !response.Allowed {
+		t.Fatalf("Expected an internal PVC to be allowed in a namespace with only employees: %v", response.Result)
+	}
+}
+
+// PVCs that are not internal buckets are allowed whoever is in the namespace
+func TestExternalPVCWithNonEmployeeIsAllowed(t *testing.T) {
+	response := reviewFixture(t, "/validate-internal-pvcs", "internal_pvcs/4_external_pvc_with_non_employee.json")
+	if !response.Allowed {
+		t.Fatalf("Expected a PVC that is not an internal bucket to be allowed: %v", response.Result)
+	}
+}
+
+// Build an authorization webhook whose Namespace cache holds test, with internal blob storage,
+// protected, with protected data, and bob, without either label
+func newMockAuthorizationWebhook(t *testing.T, failClosed bool) *Webhook {
+	selectors, _ := ParseSensitiveNamespaceSelectors(EXISTS_INTERNAL_BLOB_STORAGE + "=true; data.statcan.gc.ca/classification=protected-b")
+	options := mockWebhookOptions
+	options.SensitiveNamespaceSelectors = selectors
+	options.SensitiveNamespaceExceptionList = "sensitiveNamespaceExceptions"
+	options.AuthorizationFailClosed = failClosed
+
+	return NewWebhook(newMockListerController(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test", Labels: map[string]string{EXISTS_INTERNAL_BLOB_STORAGE: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "protected", Labels: map[string]string{"data.statcan.gc.ca/classification": "protected-b"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "bob", Labels: map[string]string{EXISTS_INTERNAL_BLOB_STORAGE: "false"}}},
+	), options)
+}
+
+// Send a SubjectAccessReview fixture through the authorization webhook and return its status
+func authorizeFixture(t *testing.T, webhook *Webhook, filePath string) authorizationv1.SubjectAccessReviewStatus {
+	body, err := ioutil.ReadFile(filepath.Join(TEST_DIRECTORY, "webhook", "authorization", filePath))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %v", filePath, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	webhook.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 from /authorize but got %d", recorder.Code)
+	}
+
+	review := &authorizationv1.SubjectAccessReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), review); err != nil {
+		t.Fatalf("Failed to decode response for %s: %v", filePath, err)
+	}
+	if review.Status.Allowed {
+		t.Fatalf("Expected the authorization webhook to never allow a request, got %+v for %s", review.Status, filePath)
+	}
+	return review.Status
+}
+
+func TestAuthorizationWebhook(t *testing.T) {
+	webhook := newMockAuthorizationWebhook(t, true)
+	for _, test := range []struct {
+		fixture string
+		denied  bool
+	}{
+		{"1_non_employee_gets_pod_in_internal_storage_namespace.json", true},
+		{"2_employee_gets_pod_in_internal_storage_namespace.json", false},
+		{"3_non_employee_lists_pods_in_unlabelled_namespace.json", false},
+		{"4_excepted_user_lists_secrets_in_protected_namespace.json", false},
+		{"5_non_employee_gets_protected_namespace.json", true},
+		{"6_non_employee_non_resource_request.json", false},
+	} {
+		status := authorizeFixture(t, webhook, test.fixture)
+		if status.Denied != test.denied {
+			t.Errorf("Expected denied=%t for %s but got %+v", test.denied, test.fixture, status)
+		}
+		if status.Denied && !strings.Contains(status.Reason, "test@external.ca is not an employee") {
+			t.Errorf("Expected the reason to name test@external.ca for %s but got %q", test.fixture, status.Reason)
+		}
+	}
+}
+
+// Before the Namespace cache is synced, requests of non-employees follow the failure policy
+func TestAuthorizationWebhookFailurePolicy(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		webhook := newMockAuthorizationWebhook(t, failClosed)
+		webhook.controller.namespaceSynced = func() bool { return false }
+
+		status := authorizeFixture(t, webhook, "1_non_employee_gets_pod_in_internal_storage_namespace.json")
+		if status.Denied != failClosed {
+			t.Errorf("Expected denied=%t when failing closed=%t but got %+v", failClosed, failClosed, status)
+		}
+		if !failClosed && status.EvaluationError == "" {
+			t.Errorf("Expected an evaluation error when failing open but got %+v", status)
+		}
+
+		// Employees are never affected
+		if status := authorizeFixture(t, webhook, "2_employee_gets_pod_in_internal_storage_namespace.json"); status.Denied {
+			t.Errorf("Expected no opinion on an employee when failing closed=%t but got %+v", failClosed, status)
+		}
+	}
+}
+
+func TestParseAuthorizationFailurePolicy(t *testing.T) {
+	if failClosed, err := ParseAuthorizationFailurePolicy("closed"); err != nil || !failClosed {
+		t.Errorf("Expected closed to fail closed, got %t %v", failClosed, err)
+	}
+	if failClosed, err := ParseAuthorizationFailurePolicy("open"); err != nil || failClosed {
+		t.Errorf("Expected open to fail open, got %t %v", failClosed, err)
+	}
+	if _, err := ParseAuthorizationFailurePolicy(""); err == nil {
+		t.Errorf("Expected an error for an empty failure policy")
+	}
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/statcan/profile-state-controller/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MAX_WHATIF_REQUEST_BYTES limits the size of the body of a what-if request
+const MAX_WHATIF_REQUEST_BYTES = 1 << 20
+
+// WhatIfRequest proposes a change to a namespace. At least one of the changes must be set.
+type WhatIfRequest struct {
+	Namespace string `json:"namespace"`
+	// Subject is a contributor to add, as a User unless another kind is given
+	Subject *rbacv1.Subject `json:"subject,omitempty"`
+	// RoleBinding is created, or replaces the RoleBinding of the same name
+	RoleBinding *rbacv1.RoleBinding `json:"roleBinding,omitempty"`
+	// PodImage is the image of a pod to start
+	PodImage string `json:"podImage,omitempty"`
+	// PersistentVolumeClaim is the name of a PVC to create
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+}
+
+// Validate returns an error when the request has no namespace or proposes nothing
+func (request WhatIfRequest) Validate() error {
+	if request.Namespace == "" {
+		return fmt.Errorf("namespace is required")
+	}
+	if request.Subject == nil && request.RoleBinding == nil && request.PodImage == "" && request.PersistentVolumeClaim == "" {
+		return fmt.Errorf("nothing is proposed: set subject, roleBinding, podImage or persistentVolumeClaim")
+	}
+	return nil
+}
+
+// LabelChange is a state label whose value would change
+type LabelChange struct {
+	Label string `json:"label"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// WhatIfResult is the state a namespace would have after a proposed change
+type WhatIfResult struct {
+	Evaluation
+	// Changes lists the labels that the change would flip
+	Changes []LabelChange `json:"changes"`
+	// Warnings describe the risky combinations of labels that the change would introduce
+	Warnings []string `json:"warnings"`
+}
+
+// WhatIf evaluates a namespace from the caches as if the proposed change had been applied,
+// with the same detectors as syncHandler.
+func (c *Controller) WhatIf(request WhatIfRequest) (*WhatIfResult, error) {
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := c.profileInformerLister.Lister().Get(request.Namespace); err != nil {
+		return nil, err
+	}
+	current, err := c.namespaceObjects(request.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	proposed := proposeObjects(request, current)
+	before, _ := policy.Evaluate(current, c.policyConfig())
+	after := evaluate(request.Namespace, proposed, c.policyConfig())
+
+	result := &WhatIfResult{Evaluation: after, Changes: []LabelChange{}, Warnings: []string{}}
+	for _, transition := range stateTransitions(before.Labels(), after.Labels) {
+		result.Changes = append(result.Changes, LabelChange{Label: transition.label, From: transition.oldValue, To: transition.newValue})
+	}
+	for _, combination := range riskyCombinations {
+		if combination.matches(after.Labels) && !combination.matches(before.Labels()) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s and %s would both be true: %s",
+				combination.feature, combination.users, combination.description))
+		}
+	}
+	return result, nil
+}
+
+// proposeObjects adds the proposed objects to a copy of the objects of a namespace
+func proposeObjects(request WhatIfRequest, current NamespaceObjects) NamespaceObjects {
+	proposed := NamespaceObjects{
+		Pods:                   append([]*corev1.Pod{}, current.Pods...),
+		PersistentVolumeClaims: append([]*corev1.PersistentVolumeClaim{}, current.PersistentVolumeClaims...),
+	}
+
+	for _, roleBinding := range current.RoleBindings {
+		if request.RoleBinding == nil || roleBinding.Name != request.RoleBinding.Name {
+			proposed.RoleBindings = append(proposed.RoleBindings, roleBinding)
+		}
+	}
+	if request.RoleBinding != nil {
+		roleBinding := request.RoleBinding.DeepCopy()
+		roleBinding.Namespace = request.Namespace
+		proposed.RoleBindings = append(proposed.RoleBindings, roleBinding)
+	}
+	if request.Subject != nil {
+		subject := *request.Subject
+		if subject.Kind == "" {
+			subject.Kind = "User"
+		}
+		proposed.RoleBindings = append(proposed.RoleBindings, &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "proposed-contributor", Namespace: request.Namespace},
+			Subjects:   []rbacv1.Subject{subject},
+		})
+	}
+
+	if request.PodImage != "" {
+		proposed.Pods = append(proposed.Pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "proposed-pod", Namespace: request.Namespace},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "proposed", Image: request.PodImage}},
+			},
+		})
+	}
+	if request.PersistentVolumeClaim != "" {
+		proposed.PersistentVolumeClaims = append(proposed.PersistentVolumeClaims, &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: request.PersistentVolumeClaim, Namespace: request.Namespace},
+		})
+	}
+
+	return proposed
+}
+
+// serveWhatIf answers POST /whatif with the WhatIfResult of the WhatIfRequest in the body
+func (api *apiHandler) serveWhatIf(w http.ResponseWriter, r *http.Request) {
+	c := api.controller
+	if !c.checkAPIRequest(w, r, http.MethodPost) {
+		return
+	}
+
+	request := WhatIfRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_WHATIF_REQUEST_BYTES)).Decode(&request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	if err := request.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !api.authorized(w, r, request.Namespace) {
+		return
+	}
+
+	result, err := c.WhatIf(request)
+	if errors.IsNotFound(err) {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("profile %s not found", request.Namespace))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAPIResponse(w, result)
+}
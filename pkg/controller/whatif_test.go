@@ -0,0 +1,123 @@
+/*
+These tests propose changes to the namespaces of the mock report controller and check the state they would lead to.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func whatIf(t *testing.T, request WhatIfRequest) *WhatIfResult {
+	result, err := newMockReportController(t).WhatIf(request)
+	if err != nil {
+		t.Fatalf("WhatIf failed: %v", err)
+	}
+	return result
+}
+
+func changedLabels(result *WhatIfResult) string {
+	labels := []string{}
+	for _, change := range result.Changes {
+		labels = append(labels, change.Label+"="+change.To)
+	}
+	return strings.Join(labels, ",")
+}
+
+// Adding an external contributor next to alice's SAS notebook is risky
+func TestWhatIfExternalContributorInSasNamespace(t *testing.T) {
+	result := whatIf(t, WhatIfRequest{Namespace: "alice", Subject: &rbacv1.Subject{Name: "someone@external.ca"}})
+
+	expected := strings.Join([]string{
+		EXISTS_NON_SAS_NOTEBOOK_USER_LABEL + "=true",
+		EXISTS_NON_CLOUD_MAIN_USER_LABEL + "=true",
+		NON_EMPLOYEE_USER + "=true",
+	}, ",")
+	if changes := changedLabels(result); changes != expected {
+		t.Fatalf("Expected changes %s but got %s", expected, changes)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "SAS notebook") {
+		t.Fatalf("Expected a warning about the SAS notebook but got %v", result.Warnings)
+	}
+}
+
+// A contributor in sasNotebookExceptions is still a non-employee, which matters for internal storage
+func TestWhatIfExceptedContributorInInternalStorageNamespace(t *testing.T) {
+	result := whatIf(t, WhatIfRequest{Namespace: "test", Subject: &rbacv1.Subject{Kind: "User", Name: "jane.doe@notanemployee.ca"}})
+
+	if changes := changedLabels(result); changes != NON_EMPLOYEE_USER+"=true" {
+		t.Fatalf("Expected only non-employee-users to change but got %s", changes)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "internal FDI storage") {
+		t.Fatalf("Expected a warning about internal storage but got %v", result.Warnings)
+	}
+}
+
+// Starting a SAS pod in sam, which has an external user, is risky
+func TestWhatIfSasPodWithExternalUser(t *testing.T) {
+	result := whatIf(t, WhatIfRequest{Namespace: "sam", PodImage: SAS_PREFIX + "latest"})
+
+	if changes := changedLabels(result); changes != HAS_SAS_NOTEBOOK_FEATURE_LABEL+"=true" {
+		t.Fatalf("Expected only has-sas-notebook-feature to change but got %s", changes)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("Expected a warning but got %v", result.Warnings)
+	}
+}
+
+// Replacing bob's RoleBinding and mounting internal storage with employees only is fine
+func TestWhatIfSafeChanges(t *testing.T) {
+	result := whatIf(t, WhatIfRequest{
+		Namespace: "bob",
+		RoleBinding: &rbacv1.RoleBinding{
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "bob@statcan.gc.ca"}},
+		},
+		PersistentVolumeClaim: "fdi-bob-iprotb",
+	})
+
+	if changes := changedLabels(result); changes != EXISTS_INTERNAL_BLOB_STORAGE+"=true" {
+		t.Fatalf("Expected only exists-internal-blob-storage to change but got %s", changes)
+	}
+	if len(result.Warnings) != 0 {
+		t.Fatalf("Expected no warnings but got %v", result.Warnings)
+	}
+}
+
+func postWhatIf(t *testing.T, method string, body string) int {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, "/whatif", bytes.NewBufferString(body))
+	newMockReportController(t).APIHandler(nil).ServeHTTP(recorder, request)
+	if recorder.Code == http.StatusOK {
+		result := WhatIfResult{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Failed to decode the response: %v", err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestServeWhatIf(t *testing.T) {
+	for _, test := range []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, `{"namespace": "alice", "subject": {"name": "someone@external.ca"}}`, http.StatusOK},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, `{"namespace": "alice"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"podImage": "` + SAS_PREFIX + `latest"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"namespace": "nobody", "podImage": "` + SAS_PREFIX + `latest"}`, http.StatusNotFound},
+		{http.MethodPost, `{"namespace": "alice", "podImage": "` + strings.Repeat("x", MAX_WHATIF_REQUEST_BYTES) + `"}`, http.StatusBadRequest},
+	} {
+		if code := postWhatIf(t, test.method, test.body); code != test.code {
+			t.Errorf("Expected %d for %s %s but got %d", test.code, test.method, test.body, code)
+		}
+	}
+}
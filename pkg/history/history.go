@@ -0,0 +1,193 @@
+// Package history keeps the state transitions of each Profile in a ConfigMap, so that the time
+// a namespace first had a given combination of labels can be found after the fact. Each history
+// is bounded by a number of entries, by their age and by the size of the ConfigMap, and is owned
+// by its Profile so that it is deleted along with it.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// PROFILE_LABEL names the Profile of a history ConfigMap
+const PROFILE_LABEL = "state.aaw.statcan.gc.ca/history-of"
+
+// DATA_KEY is the key of the entries in a history ConfigMap
+const DATA_KEY = "history.json"
+
+// MAX_DATA_BYTES bounds the entries of a history ConfigMap, well below the 1 MiB limit of an object
+const MAX_DATA_BYTES = 900 * 1024
+
+// MAX_REASONS is the number of reasons kept per entry
+const MAX_REASONS = 20
+
+// Entry is the transition of one state label
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Label   string    `json:"label"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Trigger string    `json:"trigger"`
+	// Reasons explain the new value of the label
+	Reasons []string `json:"reasons"`
+}
+
+// Options configures where histories are kept and how much of them
+type Options struct {
+	// Namespace holds one ConfigMap per Profile
+	Namespace string
+
+	// Limit is the number of entries kept per Profile, the oldest being dropped first
+	Limit int
+
+	// Retention is how long entries are kept
+	Retention time.Duration
+}
+
+// Store reads and appends to the histories of Profiles
+type Store struct {
+	client  kubernetes.Interface
+	options Options
+	now     func() time.Time
+}
+
+// NewStore creates a Store that keeps histories in ConfigMaps
+func NewStore(client kubernetes.Interface, options Options) *Store {
+	return &Store{
+		client:  client,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// ConfigMapName returns the name of the history ConfigMap of a Profile
+func ConfigMapName(profile string) string {
+	return "profile-state-history-" + profile
+}
+
+// Append adds entries to the history of a Profile, creating it if needed, and drops the entries
+// beyond the limits. The ConfigMap is owned by the given Profile.
+func (s *Store) Append(ctx context.Context, profile string, owner metav1.OwnerReference, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	configMaps := s.client.CoreV1().ConfigMaps(s.options.Namespace)
+
+	// Another replica may have written the history in the meantime
+	conflict := func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, conflict, func() error {
+		configMap, err := configMaps.Get(ctx, ConfigMapName(profile), metav1.GetOptions{})
+		exists := err == nil
+		if errors.IsNotFound(err) {
+			configMap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      ConfigMapName(profile),
+					Namespace: s.options.Namespace,
+					Labels:    map[string]string{PROFILE_LABEL: profile},
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		history, err := decode(configMap)
+		if err != nil {
+			return err
+		}
+		data, err := encode(s.prune(append(history, entries...)))
+		if err != nil {
+			return err
+		}
+
+		configMap = configMap.DeepCopy()
+		configMap.OwnerReferences = []metav1.OwnerReference{owner}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[DATA_KEY] = string(data)
+		if exists {
+			_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		} else {
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		}
+		return err
+	})
+}
+
+// List returns the history of a Profile, oldest first. A Profile without history has no entries.
+func (s *Store) List(ctx context.Context, profile string) ([]Entry, error) {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.options.Namespace).Get(ctx, ConfigMapName(profile), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	history, err := decode(configMap)
+	if err != nil {
+		return nil, err
+	}
+	return s.prune(history), nil
+}
+
+// prune drops the entries older than the retention, then the oldest entries beyond the limit
+func (s *Store) prune(history []Entry) []Entry {
+	kept := []Entry{}
+	for _, entry := range history {
+		if s.options.Retention <= 0 || s.now().Sub(entry.Time) <= s.options.Retention {
+			kept = append(kept, entry)
+		}
+	}
+	if s.options.Limit > 0 && len(kept) > s.options.Limit {
+		kept = kept[len(kept)-s.options.Limit:]
+	}
+	return kept
+}
+
+// encode truncates the reasons of each entry to MAX_REASONS, then drops the oldest entries until
+// the history fits in MAX_DATA_BYTES
+func encode(history []Entry) ([]byte, error) {
+	truncated := make([]Entry, len(history))
+	for i, entry := range history {
+		if len(entry.Reasons) > MAX_REASONS {
+			reasons := append([]string{}, entry.Reasons[:MAX_REASONS]...)
+			entry.Reasons = append(reasons, fmt.Sprintf("and %d more", len(entry.Reasons)-MAX_REASONS))
+		}
+		truncated[i] = entry
+	}
+
+	for {
+		data, err := json.Marshal(truncated)
+		if err != nil || len(data) <= MAX_DATA_BYTES || len(truncated) == 0 {
+			return data, err
+		}
+		// Drop about as many entries as the excess takes, and at least one
+		drop := len(truncated) * (len(data) - MAX_DATA_BYTES) / len(data)
+		if drop < 1 {
+			drop = 1
+		}
+		truncated = truncated[drop:]
+	}
+}
+
+func decode(configMap *corev1.ConfigMap) ([]Entry, error) {
+	history := []Entry{}
+	data, ok := configMap.Data[DATA_KEY]
+	if !ok || data == "" {
+		return history, nil
+	}
+	if err := json.Unmarshal([]byte(data), &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
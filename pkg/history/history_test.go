@@ -0,0 +1,129 @@
+package history
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const label = "state.aaw.statcan.gc.ca/non-employee-users"
+
+func newTestStore(options Options, now time.Time) *Store {
+	options.Namespace = "statcan-system"
+	store := NewStore(fake.NewSimpleClientset(), options)
+	store.now = func() time.Time { return now }
+	return store
+}
+
+var owner = metav1.OwnerReference{APIVersion: "kubeflow.org/v1", Kind: "Profile", Name: "alice", UID: "alice-uid"}
+
+func entryAt(at time.Time, to string) Entry {
+	return Entry{Time: at, Label: label, From: "", To: to, Trigger: "RoleBinding alice/user-test", Reasons: []string{"reason"}}
+}
+
+func TestAppendCreatesConfigMap(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestStore(Options{}, now)
+	ctx := context.Background()
+
+	if err := store.Append(ctx, "alice", owner, []Entry{entryAt(now, "true")}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := store.Append(ctx, "alice", owner, []Entry{entryAt(now.Add(time.Minute), "false")}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	configMap, err := store.client.CoreV1().ConfigMaps("statcan-system").Get(ctx, ConfigMapName("alice"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected a history ConfigMap: %v", err)
+	}
+	if configMap.Labels[PROFILE_LABEL] != "alice" {
+		t.Errorf("Expected the ConfigMap to be labelled with its profile but got %v", configMap.Labels)
+	}
+	if len(configMap.OwnerReferences) != 1 || configMap.OwnerReferences[0] != owner {
+		t.Errorf("Expected the ConfigMap to be owned by its profile but got %v", configMap.OwnerReferences)
+	}
+
+	entries, err := store.List(ctx, "alice")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].To != "true" || entries[1].To != "false" || entries[0].Reasons[0] != "reason" {
+		t.Fatalf("Expected both entries, oldest first, but got %+v", entries)
+	}
+}
+
+func TestAppendPrunesByLimitAndRetention(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestStore(Options{Limit: 2, Retention: 24 * time.Hour}, now)
+	ctx := context.Background()
+
+	err := store.Append(ctx, "alice", owner, []Entry{
+		entryAt(now.Add(-48*time.Hour), "expired"),
+		entryAt(now.Add(-3*time.Hour), "dropped"),
+		entryAt(now.Add(-2*time.Hour), "kept"),
+		entryAt(now.Add(-1*time.Hour), "latest"),
+	})
+	if err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	entries, err := store.List(ctx, "alice")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(entries) != 2 || entries[0].To != "kept" || entries[1].To != "latest" {
+		t.Fatalf("Expected the 2 most recent entries but got %+v", entries)
+	}
+}
+
+// Long lists of reasons are truncated and the oldest entries are dropped to fit in a ConfigMap
+func TestAppendBoundsSize(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := newTestStore(Options{}, now)
+	ctx := context.Background()
+
+	reasons := []string{}
+	for i := 0; i < 2*MAX_REASONS; i++ {
+		reasons = append(reasons, strings.Repeat("x", 1000))
+	}
+	entries := []Entry{}
+	for i := 0; i < 100; i++ {
+		entry := entryAt(now.Add(time.Duration(i)*time.Minute), "true")
+		entry.Reasons = reasons
+		entries = append(entries, entry)
+	}
+	if err := store.Append(ctx, "alice", owner, entries); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+
+	configMap, err := store.client.CoreV1().ConfigMaps("statcan-system").Get(ctx, ConfigMapName("alice"), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected a history ConfigMap: %v", err)
+	}
+	if size := len(configMap.Data[DATA_KEY]); size > MAX_DATA_BYTES {
+		t.Fatalf("Expected the history to fit in %d bytes but got %d", MAX_DATA_BYTES, size)
+	}
+	kept, err := store.List(ctx, "alice")
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(kept) == 0 || len(kept) == len(entries) || !kept[len(kept)-1].Time.Equal(entries[len(entries)-1].Time) {
+		t.Fatalf("Expected only the most recent entries to be kept but got %d", len(kept))
+	}
+	last := kept[len(kept)-1].Reasons
+	if len(last) != MAX_REASONS+1 || last[MAX_REASONS] != "and 20 more" {
+		t.Fatalf("Expected the reasons to be truncated but got %d: %v", len(last), last[len(last)-1])
+	}
+}
+
+func TestListWithoutHistory(t *testing.T) {
+	entries, err := newTestStore(Options{}, time.Now()).List(context.Background(), "nobody")
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected an empty history but got %v %v", entries, err)
+	}
+}
@@ -0,0 +1,240 @@
+// Package policy computes the state of a namespace from its Pods, RoleBindings and
+// PersistentVolumeClaims. It does not read from a cluster or keep any state, so the controller,
+// its commands and other controllers can all apply the same policy.
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// SAS_PREFIX starts the image of every SAS notebook
+const SAS_PREFIX = "k8scc01covidacr.azurecr.io/sas:"
+
+// State labels
+const (
+	HAS_SAS_NOTEBOOK_FEATURE_LABEL     = "state.aaw.statcan.gc.ca/has-sas-notebook-feature"
+	EXISTS_NON_SAS_NOTEBOOK_USER_LABEL = "state.aaw.statcan.gc.ca/exists-non-sas-notebook-user"
+	EXISTS_NON_CLOUD_MAIN_USER_LABEL   = "state.aaw.statcan.gc.ca/exists-non-cloud-main-user"
+	EXISTS_INTERNAL_BLOB_STORAGE       = "state.aaw.statcan.gc.ca/exists-internal-blob-storage"
+	NON_EMPLOYEE_USER                  = "state.aaw.statcan.gc.ca/non-employee-users"
+)
+
+// Lists of the exceptions configuration
+const (
+	SAS_NOTEBOOK_EXCEPTIONS = "sasNotebookExceptions"
+	CLOUD_MAIN_EXCEPTIONS   = "cloudMainExceptions"
+)
+
+var employeeDomains = []string{"cloud.statcan.ca", "statcan.gc.ca"}
+
+// StateLabels returns the state labels, in the order of the fields of State
+func StateLabels() []string {
+	return []string{
+		HAS_SAS_NOTEBOOK_FEATURE_LABEL,
+		EXISTS_NON_SAS_NOTEBOOK_USER_LABEL,
+		EXISTS_NON_CLOUD_MAIN_USER_LABEL,
+		NON_EMPLOYEE_USER,
+		EXISTS_INTERNAL_BLOB_STORAGE,
+	}
+}
+
+// EmployeeDomains returns the email domains of employees
+func EmployeeDomains() []string {
+	return append([]string{}, employeeDomains...)
+}
+
+// Inputs are the objects of one namespace that the policy looks at
+type Inputs struct {
+	Pods                   []*corev1.Pod
+	RoleBindings           []*rbacv1.RoleBinding
+	PersistentVolumeClaims []*corev1.PersistentVolumeClaim
+}
+
+// Config holds the exceptions configuration, which maps each list, such as
+// sasNotebookExceptions, onto the users it lets use a feature without being employees
+type Config struct {
+	Exceptions map[string][]string
+}
+
+// State is the state of a namespace, with one field per state label
+type State struct {
+	HasSasNotebookFeature     bool `json:"hasSasNotebookFeature"`
+	ExistsNonSasNotebookUser  bool `json:"existsNonSasNotebookUser"`
+	ExistsNonCloudMainUser    bool `json:"existsNonCloudMainUser"`
+	NonEmployeeUsers          bool `json:"nonEmployeeUsers"`
+	ExistsInternalBlobStorage bool `json:"existsInternalBlobStorage"`
+}
+
+// Values returns the value of every state label, in the order of StateLabels
+func (s State) Values() []bool {
+	return []bool{
+		s.HasSasNotebookFeature,
+		s.ExistsNonSasNotebookUser,
+		s.ExistsNonCloudMainUser,
+		s.NonEmployeeUsers,
+		s.ExistsInternalBlobStorage,
+	}
+}
+
+// Labels returns the state as the labels set on Profiles and Namespaces
+func (s State) Labels() map[string]string {
+	labels := map[string]string{}
+	values := s.Values()
+	for i, label := range StateLabels() {
+		labels[label] = strconv.FormatBool(values[i])
+	}
+	return labels
+}
+
+// Reasons explain the value of each state label
+type Reasons map[string][]string
+
+// Evaluate computes the state of a namespace and the reasons behind each label
+func Evaluate(inputs Inputs, config Config) (State, Reasons) {
+	state := State{}
+	reasons := Reasons{}
+	for _, label := range StateLabels() {
+		reasons[label] = []string{}
+	}
+
+	for _, pod := range inputs.Pods {
+		if image, ok := sasImage(pod); ok {
+			state.HasSasNotebookFeature = true
+			reasons[HAS_SAS_NOTEBOOK_FEATURE_LABEL] = append(reasons[HAS_SAS_NOTEBOOK_FEATURE_LABEL],
+				fmt.Sprintf("pod %s/%s runs the SAS image %s", pod.Namespace, pod.Name, image))
+		}
+	}
+
+	for _, roleBinding := range inputs.RoleBindings {
+		for _, subject := range roleBinding.Subjects {
+			if config.NonSasUser(subject) {
+				state.ExistsNonSasNotebookUser = true
+				reasons[EXISTS_NON_SAS_NOTEBOOK_USER_LABEL] = append(reasons[EXISTS_NON_SAS_NOTEBOOK_USER_LABEL],
+					exceptedUserReason(roleBinding, subject, SAS_NOTEBOOK_EXCEPTIONS))
+			}
+			if config.NonCloudMainUser(subject) {
+				state.ExistsNonCloudMainUser = true
+				reasons[EXISTS_NON_CLOUD_MAIN_USER_LABEL] = append(reasons[EXISTS_NON_CLOUD_MAIN_USER_LABEL],
+					exceptedUserReason(roleBinding, subject, CLOUD_MAIN_EXCEPTIONS))
+			}
+			if NonEmployee(subject) {
+				state.NonEmployeeUsers = true
+				reasons[NON_EMPLOYEE_USER] = append(reasons[NON_EMPLOYEE_USER],
+					fmt.Sprintf("user %s in RoleBinding %s is not an employee (%s)", subject.Name, roleBinding.Name, NonEmployeeReason(subject.Name)))
+			}
+		}
+	}
+
+	for _, pvc := range inputs.PersistentVolumeClaims {
+		if InternalPVC(pvc.Name) {
+			state.ExistsInternalBlobStorage = true
+			reasons[EXISTS_INTERNAL_BLOB_STORAGE] = append(reasons[EXISTS_INTERNAL_BLOB_STORAGE],
+				fmt.Sprintf("PVC %s/%s mounts an internal bucket (its name contains iunc or iprotb)", pvc.Namespace, pvc.Name))
+		}
+	}
+
+	// A label that is false is explained by the absence of what would set it
+	for label, reason := range map[string]string{
+		HAS_SAS_NOTEBOOK_FEATURE_LABEL:     fmt.Sprintf("no pod runs an image starting with %s", SAS_PREFIX),
+		EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: fmt.Sprintf("every user is an employee or is in %s", SAS_NOTEBOOK_EXCEPTIONS),
+		EXISTS_NON_CLOUD_MAIN_USER_LABEL:   fmt.Sprintf("every user is an employee or is in %s", CLOUD_MAIN_EXCEPTIONS),
+		NON_EMPLOYEE_USER:                  "no user has an email address outside the employee domains",
+		EXISTS_INTERNAL_BLOB_STORAGE:       "no PVC name contains iunc or iprotb",
+	} {
+		if len(reasons[label]) == 0 {
+			reasons[label] = append(reasons[label], reason)
+		}
+	}
+
+	return state, reasons
+}
+
+func exceptedUserReason(roleBinding *rbacv1.RoleBinding, subject rbacv1.Subject, exceptionList string) string {
+	return fmt.Sprintf("user %s in RoleBinding %s is not an employee (%s) and is not in %s",
+		subject.Name, roleBinding.Name, NonEmployeeReason(subject.Name), exceptionList)
+}
+
+// InternalUser returns whether an email address belongs to an employee, that is whether its
+// domain is an employee domain or one of its subdomains
+func InternalUser(email string) bool {
+	for _, domain := range employeeDomains {
+		if strings.HasSuffix(email, "@"+domain) || strings.HasSuffix(email, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// SasImage returns whether a container of the pod runs a SAS image
+func SasImage(pod *corev1.Pod) bool {
+	_, ok := sasImage(pod)
+	return ok
+}
+
+func sasImage(pod *corev1.Pod) (string, bool) {
+	for _, container := range pod.Spec.Containers {
+		if strings.HasPrefix(container.Image, SAS_PREFIX) {
+			return container.Image, true
+		}
+	}
+	return "", false
+}
+
+// InternalPVC returns whether a PVC mounts an internal FDI bucket, which by naming convention
+// have "iunc" or "iprotb" in their names
+func InternalPVC(name string) bool {
+	return strings.Contains(name, "iunc") || strings.Contains(name, "iprotb")
+}
+
+// NonEmployee returns whether a subject is a user whose email address is outside the employee
+// domains. Users that are not named by an email address are not counted.
+func NonEmployee(subject rbacv1.Subject) bool {
+	return subject.Kind == "User" && strings.Contains(subject.Name, "@") && !InternalUser(subject.Name)
+}
+
+// NonEmployeeReason explains why a user is not recognised as an employee
+func NonEmployeeReason(name string) string {
+	if !strings.Contains(name, "@") {
+		return fmt.Sprintf("%s is not an email address", name)
+	}
+	domain := name[strings.LastIndex(name, "@")+1:]
+	return fmt.Sprintf("domain %s is not one of the employee domains %s", domain, strings.Join(employeeDomains, ", "))
+}
+
+// Excepted returns whether a user is in a list of the exceptions configuration
+func (c Config) Excepted(list string, name string) bool {
+	for _, exceptionCase := range c.Exceptions[list] {
+		if name == strings.TrimSpace(exceptionCase) {
+			return true
+		}
+	}
+	return false
+}
+
+// NonSasUser returns whether a subject is a user who may not use SAS: neither an employee
+// nor in sasNotebookExceptions
+func (c Config) NonSasUser(subject rbacv1.Subject) bool {
+	return c.notExceptedUser(subject, SAS_NOTEBOOK_EXCEPTIONS)
+}
+
+// NonCloudMainUser returns whether a subject is a user who may not use cloud main: neither
+// an employee nor in cloudMainExceptions
+func (c Config) NonCloudMainUser(subject rbacv1.Subject) bool {
+	return c.notExceptedUser(subject, CLOUD_MAIN_EXCEPTIONS)
+}
+
+func (c Config) notExceptedUser(subject rbacv1.Subject, list string) bool {
+	// Only users are checked, not groups or ServiceAccounts
+	if subject.Kind != "User" {
+		return false
+	}
+	if strings.Contains(subject.Name, "@") && InternalUser(subject.Name) {
+		return false
+	}
+	return !c.Excepted(list, subject.Name)
+}
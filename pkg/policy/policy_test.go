@@ -0,0 +1,147 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var config = Config{Exceptions: map[string][]string{
+	SAS_NOTEBOOK_EXCEPTIONS: {"alice.smith@external.ca", " jane.doe@notanemployee.ca "},
+	CLOUD_MAIN_EXCEPTIONS:   {"jane.doe@notanemployee.ca"},
+}}
+
+func roleBinding(name string, users ...string) *rbacv1.RoleBinding {
+	subjects := []rbacv1.Subject{}
+	for _, user := range users {
+		subjects = append(subjects, rbacv1.Subject{Kind: "User", Name: user})
+	}
+	return &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"}, Subjects: subjects}
+}
+
+func pod(name string, images ...string) *corev1.Pod {
+	containers := []corev1.Container{}
+	for _, image := range images {
+		containers = append(containers, corev1.Container{Name: name, Image: image})
+	}
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"}, Spec: corev1.PodSpec{Containers: containers}}
+}
+
+func pvc(name string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"}}
+}
+
+func TestEvaluate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		inputs   Inputs
+		expected State
+	}{
+		{"empty namespace", Inputs{}, State{}},
+		{"employees only", Inputs{
+			Pods:         []*corev1.Pod{pod("notebook", "jupyter/datascience-notebook")},
+			RoleBindings: []*rbacv1.RoleBinding{roleBinding("owner", "alice@statcan.gc.ca", "bob@cloud.statcan.ca")},
+		}, State{}},
+		{"SAS notebook in a sidecar", Inputs{
+			Pods: []*corev1.Pod{pod("notebook", "jupyter/datascience-notebook", SAS_PREFIX+"latest")},
+		}, State{HasSasNotebookFeature: true}},
+		{"non-employee without exceptions", Inputs{
+			RoleBindings: []*rbacv1.RoleBinding{roleBinding("contributor", "test@external.ca")},
+		}, State{ExistsNonSasNotebookUser: true, ExistsNonCloudMainUser: true, NonEmployeeUsers: true}},
+		{"non-employee in sasNotebookExceptions only", Inputs{
+			RoleBindings: []*rbacv1.RoleBinding{roleBinding("contributor", "alice.smith@external.ca")},
+		}, State{ExistsNonCloudMainUser: true, NonEmployeeUsers: true}},
+		{"non-employee in both exceptions lists", Inputs{
+			RoleBindings: []*rbacv1.RoleBinding{roleBinding("contributor", "jane.doe@notanemployee.ca")},
+		}, State{NonEmployeeUsers: true}},
+		{"user without an email address", Inputs{
+			RoleBindings: []*rbacv1.RoleBinding{roleBinding("contributor", "admin")},
+		}, State{ExistsNonSasNotebookUser: true, ExistsNonCloudMainUser: true}},
+		{"ServiceAccounts are ignored", Inputs{
+			RoleBindings: []*rbacv1.RoleBinding{{Subjects: []rbacv1.Subject{{Kind: "ServiceAccount", Name: "default"}}}},
+		}, State{}},
+		{"internal storage", Inputs{
+			PersistentVolumeClaims: []*corev1.PersistentVolumeClaim{pvc("fdi-test-external"), pvc("fdi-test-iprotb-protected-b")},
+		}, State{ExistsInternalBlobStorage: true}},
+	} {
+		state, reasons := Evaluate(test.inputs, config)
+		if state != test.expected {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, state)
+		}
+		for _, label := range StateLabels() {
+			if len(reasons[label]) == 0 {
+				t.Errorf("%s: expected reasons for %s", test.name, label)
+			}
+		}
+	}
+}
+
+// Each reason names the object that set the label
+func TestEvaluateReasons(t *testing.T) {
+	_, reasons := Evaluate(Inputs{
+		Pods:                   []*corev1.Pod{pod("sas", SAS_PREFIX+"452")},
+		RoleBindings:           []*rbacv1.RoleBinding{roleBinding("contributor", "test@external.ca")},
+		PersistentVolumeClaims: []*corev1.PersistentVolumeClaim{pvc("fdi-test-iunc-unclassified")},
+	}, config)
+
+	for label, expected := range map[string]string{
+		HAS_SAS_NOTEBOOK_FEATURE_LABEL:     "pod test/sas runs the SAS image",
+		EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: "test@external.ca in RoleBinding contributor is not an employee (domain external.ca",
+		EXISTS_NON_CLOUD_MAIN_USER_LABEL:   "is not in " + CLOUD_MAIN_EXCEPTIONS,
+		NON_EMPLOYEE_USER:                  "test@external.ca in RoleBinding contributor",
+		EXISTS_INTERNAL_BLOB_STORAGE:       "PVC test/fdi-test-iunc-unclassified",
+	} {
+		if len(reasons[label]) != 1 || !strings.Contains(reasons[label][0], expected) {
+			t.Errorf("Expected the reason for %s to contain %q but got %v", label, expected, reasons[label])
+		}
+	}
+}
+
+func TestStateLabels(t *testing.T) {
+	labels := State{HasSasNotebookFeature: true, ExistsInternalBlobStorage: true}.Labels()
+	if len(labels) != len(StateLabels()) {
+		t.Fatalf("Expected a value for every state label but got %v", labels)
+	}
+	for label, expected := range map[string]string{
+		HAS_SAS_NOTEBOOK_FEATURE_LABEL:     "true",
+		EXISTS_NON_SAS_NOTEBOOK_USER_LABEL: "false",
+		EXISTS_NON_CLOUD_MAIN_USER_LABEL:   "false",
+		NON_EMPLOYEE_USER:                  "false",
+		EXISTS_INTERNAL_BLOB_STORAGE:       "true",
+	} {
+		if labels[label] != expected {
+			t.Errorf("Expected %s=%s but got %s", label, expected, labels[label])
+		}
+	}
+}
+
+func TestInternalUser(t *testing.T) {
+	for email, expected := range map[string]bool{
+		"alice@statcan.gc.ca":            true,
+		"bob@cloud.statcan.ca":           true,
+		"carol@ssc.statcan.gc.ca":        true,
+		"mallory@evilstatcan.gc.ca":      false,
+		"mallory@evilcloud.statcan.ca":   false,
+		"mallory@statcan.gc.ca.evil.com": false,
+		"statcan.gc.ca":                  false,
+		"bob@external.ca":                false,
+	} {
+		if got := InternalUser(email); got != expected {
+			t.Errorf("Expected InternalUser(%q) to be %v but got %v", email, expected, got)
+		}
+	}
+}
+
+// A lookalike domain that ends with an employee domain is not an employee domain
+func TestEvaluateLookalikeDomain(t *testing.T) {
+	state, reasons := Evaluate(Inputs{RoleBindings: []*rbacv1.RoleBinding{roleBinding("lookalike", "x@evilstatcan.gc.ca")}}, config)
+	if !state.NonEmployeeUsers {
+		t.Fatalf("Expected x@evilstatcan.gc.ca to be a non-employee")
+	}
+	if reason := strings.Join(reasons[NON_EMPLOYEE_USER], " "); !strings.Contains(reason, "x@evilstatcan.gc.ca") {
+		t.Errorf("Expected the reason to name x@evilstatcan.gc.ca but got %q", reason)
+	}
+}
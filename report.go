@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/statcan/profile-state-controller/pkg/controller"
+)
+
+// runReport prints the compliance report for every Profile in the cluster
+func runReport(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	flags.StringVar(&kubeconfig, "kubeconfig", kubeconfig, "Path to a kubeconfig. Only required if out-of-cluster.")
+	flags.StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
+	exceptionsFile := flags.String("exceptions", "", "Path to a non-employee exceptions file. When empty, the exceptions are read from --exceptions-configmap.")
+	exceptionsConfigMap := flags.String("exceptions-configmap", "statcan-system/non-employee-exceptions", "Namespace/name of the ConfigMap holding the exceptions mounted into the controller.")
+	format := flags.String("format", controller.REPORT_FORMAT_CSV, "Output format: json, csv or markdown.")
+	flags.Parse(args)
+
+	kubeclient, kubeflowclient, err := buildClients()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	exceptions, err := loadExceptions(ctx, kubeclient, *exceptionsFile, *exceptionsConfigMap)
+	if err != nil {
+		return err
+	}
+
+	manifests, err := controller.FetchManifests(ctx, kubeclient, kubeflowclient)
+	if err != nil {
+		return err
+	}
+	report, err := controller.BuildReport(manifests.Profiles, manifests.LookupObjects, exceptions)
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout, *format)
+}